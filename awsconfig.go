@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ssoSession is an [sso-session name] block from the aws shared config file
+type ssoSession struct {
+	name     string
+	region   string
+	starturl string
+}
+
+// awsConfigPath is the aws shared config file, AWS_CONFIG_FILE or config in
+// the basedir
+func awsConfigPath(basedir string) string {
+	if p := os.Getenv("AWS_CONFIG_FILE"); p != "" {
+		return p
+	}
+	return filepath.Join(basedir, "config")
+}
+
+// ssoSessions reads the complete sso-session blocks from the aws shared config
+// file, in the order they appear. a missing file has no sessions
+func ssoSessions(path string) ([]ssoSession, error) {
+	f, err := os.Open(filepath.Clean(path))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cant open aws config %s: %w", path, err)
+	}
+	defer func() { _ = f.Close() }()
+
+	ss := []ssoSession{}
+	var cur *ssoSession
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";"):
+			continue
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			cur = nil
+			fields := strings.Fields(strings.Trim(line, "[]"))
+			if len(fields) == 2 && fields[0] == "sso-session" {
+				ss = append(ss, ssoSession{name: fields[1]})
+				cur = &ss[len(ss)-1]
+			}
+			continue
+		case cur == nil:
+			continue
+		}
+
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(k) {
+		case "sso_region":
+			cur.region = strings.TrimSpace(v)
+		case "sso_start_url":
+			cur.starturl = strings.TrimSpace(v)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("cant read aws config %s: %w", path, err)
+	}
+
+	complete := []ssoSession{}
+	for _, s := range ss {
+		if s.region != "" && s.starturl != "" {
+			complete = append(complete, s)
+		}
+	}
+	return complete, nil
+}
+
+// useSessions sets c up from sso sessions: a single session is the top-level
+// instance, more than one are all extra instances named after the sessions
+func (c *config) useSessions(ss []ssoSession) {
+	if len(ss) == 1 {
+		c.Region = ss[0].region
+		c.StartURL = ss[0].starturl
+		c.SSOSession = ss[0].name
+		return
+	}
+
+	names := map[string]bool{defaultInstance: true}
+	for _, s := range ss {
+		name := strings.Trim(nonName.ReplaceAllString(strings.ToLower(s.name), "-"), "-")
+		if name == "" {
+			name = "sso"
+		}
+		for n, i := name, 2; names[name]; i++ {
+			name = fmt.Sprintf("%s-%d", n, i)
+		}
+		names[name] = true
+		c.Instances = append(c.Instances, instance{
+			Name:       name,
+			Region:     s.region,
+			StartURL:   s.starturl,
+			SSOSession: s.name,
+		})
+	}
+}
+
+var nonName = regexp.MustCompile(`[^a-z0-9-]+`)
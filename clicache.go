@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/sha1" // #nosec not for security, it's how aws cli names cache files
+	"encoding/hex"
+	"encoding/json"
+	"path/filepath"
+	"time"
+)
+
+// cliToken is an sso token in the aws cli v2 cache format. tokens for an
+// sso-session also carry the client registration so either tool can refresh
+type cliToken struct {
+	StartURL              string `json:"startUrl"`
+	Region                string `json:"region"`
+	AccessToken           string `json:"accessToken"`
+	ExpiresAt             string `json:"expiresAt"`
+	RefreshToken          string `json:"refreshToken,omitempty"`
+	ClientID              string `json:"clientId,omitempty"`
+	ClientSecret          string `json:"clientSecret,omitempty"`
+	RegistrationExpiresAt string `json:"registrationExpiresAt,omitempty"`
+}
+
+// cliCachePath is where aws cli v2 caches the token for this start url: the
+// sha1 of the sso-session name, or of the start url for legacy profiles
+func (c config) cliCachePath() string {
+	key := c.SSOSession
+	if key == "" {
+		key = c.StartURL
+	}
+	sum := sha1.Sum([]byte(key)) // #nosec
+	return filepath.Join(c.basedir, "sso", "cache", hex.EncodeToString(sum[:])+".json")
+}
+
+// fromCLI loads t from the aws cli format. a token for some other start url is
+// ignored
+func (t *token) fromCLI(b []byte) error {
+	var ct cliToken
+	if err := json.Unmarshal(b, &ct); err != nil {
+		return err
+	}
+	if ct.StartURL != t.starturl {
+		return nil
+	}
+
+	t.RefreshToken = ct.RefreshToken
+	if ct.ClientID != "" {
+		t.client.ID = ct.ClientID
+		t.client.Secret = ct.ClientSecret
+		if exp, err := time.Parse(time.RFC3339, ct.RegistrationExpiresAt); err == nil {
+			t.client.ExpiresAt = exp.Unix()
+		}
+	}
+
+	exp, err := time.Parse(time.RFC3339, ct.ExpiresAt)
+	if err != nil {
+		return nil
+	}
+	t.Value = ct.AccessToken
+	t.ExpiresAt = exp
+	return nil
+}
+
+// toCLI is t in the aws cli format
+func (t token) toCLI() ([]byte, error) {
+	ct := cliToken{
+		StartURL:     t.starturl,
+		Region:       t.region,
+		AccessToken:  t.Value,
+		ExpiresAt:    t.ExpiresAt.UTC().Format(time.RFC3339),
+		RefreshToken: t.RefreshToken,
+	}
+	if t.client.ID != "" {
+		ct.ClientID = t.client.ID
+		ct.ClientSecret = t.client.Secret
+		ct.RegistrationExpiresAt = time.Unix(t.client.ExpiresAt, 0).UTC().Format(time.RFC3339)
+	}
+	return json.Marshal(ct)
+}
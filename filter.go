@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// filter hides profiles nobody wants to see. patterns are globs, or regexes
+// between slashes like "/^dev-/", matched against the account name, account id
+// and role name. with include patterns a profile must match one of them, and
+// a profile matching any exclude pattern is hidden
+type filter struct {
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+
+	include []matcher
+	exclude []matcher
+}
+
+// matcher is a compiled glob or regex pattern
+type matcher func(string) bool
+
+// compile checks and compiles the patterns
+func (f *filter) compile() error {
+	var err error
+	if f.include, err = matchers("include", f.Include); err != nil {
+		return err
+	}
+	f.exclude, err = matchers("exclude", f.Exclude)
+	return err
+}
+
+func matchers(key string, pats []string) ([]matcher, error) {
+	ms := []matcher{}
+	for _, pat := range pats {
+		if len(pat) > 1 && strings.HasPrefix(pat, "/") && strings.HasSuffix(pat, "/") {
+			re, err := regexp.Compile(pat[1 : len(pat)-1])
+			if err != nil {
+				return nil, fmt.Errorf("config error: filter %s %q: %w", key, pat, err)
+			}
+			ms = append(ms, re.MatchString)
+			continue
+		}
+		glob := strings.ToLower(pat)
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("config error: filter %s %q: %w", key, pat, err)
+		}
+		ms = append(ms, func(s string) bool {
+			ok, _ := path.Match(glob, strings.ToLower(s))
+			return ok
+		})
+	}
+	return ms, nil
+}
+
+// shows is whether the role in the account gets past the filter, no filter
+// shows everything
+func (f *filter) shows(a account, role string) bool {
+	if f == nil {
+		return true
+	}
+	hit := func(ms []matcher) bool {
+		for _, m := range ms {
+			if m(a.Name) || m(a.ID) || m(role) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(f.include) > 0 && !hit(f.include) {
+		return false
+	}
+	return !hit(f.exclude)
+}
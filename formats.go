@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// configExts are the config file formats, in order of precedence when a
+// directory has more than one config file
+var configExts = []string{".json", ".yaml", ".yml", ".toml"}
+
+// findConfig is the config file in dir and any others that lose out to it. with
+// none it's config.json, which doesnt exist
+func findConfig(dir string) (string, []string) {
+	found := []string{}
+	for _, ext := range configExts {
+		p := filepath.Join(dir, "config"+ext)
+		if _, err := os.Stat(p); err == nil {
+			found = append(found, p)
+		}
+	}
+	if len(found) < 1 {
+		return filepath.Join(dir, "config.json"), nil
+	}
+	return found[0], found[1:]
+}
+
+// formatExt is the file extension for a -format name
+func formatExt(format string) (string, error) {
+	switch strings.ToLower(format) {
+	case "json":
+		return ".json", nil
+	case "yaml", "yml":
+		return ".yaml", nil
+	case "toml":
+		return ".toml", nil
+	}
+	return "", fmt.Errorf("unknown config format %q, use json, yaml or toml", format)
+}
+
+// decodeConfig decodes a config file by its extension (json without one) into
+// a generic object, after checking every key is a config key
+func decodeConfig(path string, b []byte) (map[string]any, error) {
+	var v any
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(b, &v); err != nil {
+			return nil, fmt.Errorf("cant unmarshal config %s: %w", path, err)
+		}
+	case ".toml":
+		m := map[string]any{}
+		if _, err := toml.Decode(string(b), &m); err != nil {
+			return nil, fmt.Errorf("cant unmarshal config %s: %w", path, err)
+		}
+		v = m
+	default:
+		if err := json.Unmarshal(b, &v); err != nil {
+			return nil, fmt.Errorf("cant unmarshal config %s: %w", path, err)
+		}
+	}
+	if v == nil { // an empty yaml file
+		return map[string]any{}, nil
+	}
+
+	// round trip through json so every format has the same types
+	jb, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("cant unmarshal config %s: %w", path, err)
+	}
+	m := map[string]any{}
+	if err := json.Unmarshal(jb, &m); err != nil {
+		return nil, fmt.Errorf("config error: %s is not an object", path)
+	}
+
+	// encoding/json matches keys case-insensitively, so check them first
+	if err := checkKeys(m, reflect.TypeOf(config{}), ""); err != nil {
+		return nil, fmt.Errorf("config error: %s: %w", path, err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(jb))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&config{}); err != nil {
+		return nil, fmt.Errorf("config error: %s: %w", path, err)
+	}
+	return m, nil
+}
+
+// checkKeys checks every object key in v is spelt exactly as a json tag of the
+// struct it decodes into. at is where v is in the config, for errors
+func checkKeys(v any, t reflect.Type, at string) error {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil // a type error, for the decoder to report
+		}
+		fields := map[string]reflect.Type{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if f.IsExported() && name != "" && name != "-" {
+				fields[name] = f.Type
+			}
+		}
+		for k, fv := range m {
+			ft, ok := fields[k]
+			if !ok {
+				return fmt.Errorf("unknown key %q", at+k)
+			}
+			if err := checkKeys(fv, ft, at+k+"."); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		m, _ := v.(map[string]any)
+		for k, ev := range m {
+			if err := checkKeys(ev, t.Elem(), at+k+"."); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		l, _ := v.([]any)
+		for i, ev := range l {
+			if err := checkKeys(ev, t.Elem(), fmt.Sprintf("%s[%d].", strings.TrimSuffix(at, "."), i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// hasComments is whether a yaml or toml config has comments, which encoding it
+// again would lose
+func hasComments(path string, b []byte) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		var doc yaml.Node
+		if err := yaml.Unmarshal(b, &doc); err != nil {
+			return false
+		}
+		return yamlComments(&doc)
+	case ".toml":
+		return tomlComments(string(b))
+	}
+	return false
+}
+
+func yamlComments(n *yaml.Node) bool {
+	if n.HeadComment != "" || n.LineComment != "" || n.FootComment != "" {
+		return true
+	}
+	for _, c := range n.Content {
+		if yamlComments(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// tomlComments looks for a # outside of strings
+func tomlComments(s string) bool {
+	for i := 0; i < len(s); i++ {
+		switch {
+		case strings.HasPrefix(s[i:], `"""`) || strings.HasPrefix(s[i:], "'''"):
+			end := strings.Index(s[i+3:], s[i:i+3])
+			if end < 0 {
+				return false
+			}
+			i += end + 5
+		case s[i] == '"':
+			for i++; i < len(s) && s[i] != '"' && s[i] != '\n'; i++ {
+				if s[i] == '\\' {
+					i++
+				}
+			}
+		case s[i] == '\'':
+			for i++; i < len(s) && s[i] != '\'' && s[i] != '\n'; i++ {
+			}
+		case s[i] == '#':
+			return true
+		}
+	}
+	return false
+}
+
+// encodeConfig encodes cfg in the format for the extension of path
+func encodeConfig(path string, cfg config) ([]byte, error) {
+	jb, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext != ".yaml" && ext != ".yml" && ext != ".toml" {
+		return jb, nil
+	}
+
+	m := map[string]any{}
+	if err := json.Unmarshal(jb, &m); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if ext == ".toml" {
+		err = toml.NewEncoder(&buf).Encode(m)
+	} else {
+		enc := yaml.NewEncoder(&buf)
+		enc.SetIndent(2)
+		err = enc.Encode(m)
+	}
+	return buf.Bytes(), err
+}
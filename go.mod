@@ -3,22 +3,26 @@ module github.com/toolsdotgo/lash
 go 1.19
 
 require (
-	github.com/aws/aws-sdk-go-v2 v1.24.1
+	github.com/BurntSushi/toml v1.3.2
+	github.com/aws/aws-sdk-go-v2 v1.26.1
 	github.com/aws/aws-sdk-go-v2/config v1.26.6
 	github.com/aws/aws-sdk-go-v2/service/sso v1.18.7
-	github.com/aws/aws-sdk-go-v2/service/ssooidc v1.21.7
+	github.com/aws/aws-sdk-go-v2/service/ssooidc v1.24.0
 	github.com/pkg/browser v0.0.0-20210911075715-681adbf594b8
+	golang.org/x/term v0.20.0
+	gopkg.in/yaml.v3 v3.0.1
+	rsc.io/qr v0.2.0
 )
 
 require (
 	github.com/aws/aws-sdk-go-v2/credentials v1.16.16 // indirect
 	github.com/aws/aws-sdk-go-v2/feature/ec2/imds v1.14.11 // indirect
-	github.com/aws/aws-sdk-go-v2/internal/configsources v1.2.10 // indirect
-	github.com/aws/aws-sdk-go-v2/internal/endpoints/v2 v2.5.10 // indirect
+	github.com/aws/aws-sdk-go-v2/internal/configsources v1.3.5 // indirect
+	github.com/aws/aws-sdk-go-v2/internal/endpoints/v2 v2.6.5 // indirect
 	github.com/aws/aws-sdk-go-v2/internal/ini v1.7.3 // indirect
 	github.com/aws/aws-sdk-go-v2/service/internal/accept-encoding v1.10.4 // indirect
 	github.com/aws/aws-sdk-go-v2/service/internal/presigned-url v1.10.10 // indirect
 	github.com/aws/aws-sdk-go-v2/service/sts v1.26.7 // indirect
-	github.com/aws/smithy-go v1.19.0 // indirect
-	golang.org/x/sys v0.1.0 // indirect
+	github.com/aws/smithy-go v1.20.2 // indirect
+	golang.org/x/sys v0.20.0 // indirect
 )
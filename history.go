@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// historyMax is how many uses are kept, the oldest go first
+const historyMax = 500
+
+// a favourite has to have a frecency this high, and this many times the
+// runner up's, to be picked without asking
+const (
+	favouriteMin   = 200
+	favouriteRatio = 3
+)
+
+// history is the profiles picked, oldest first
+type history struct {
+	path string
+	Uses []use
+}
+
+type use struct {
+	Slug string
+	At   time.Time
+}
+
+func loadHistory(cfg config) (history, error) {
+	h := history{path: filepath.Join(cfg.cachedir, "history.json")}
+	fi, b, err := getFile(filepath.Clean(h.path))
+	if err != nil {
+		return h, fmt.Errorf("cant get history file %s: %w", h.path, err)
+	}
+	if fi == nil || b == nil {
+		return h, nil
+	}
+	if err := json.Unmarshal(b, &h); err != nil {
+		return h, fmt.Errorf("cant unmarshal history file %s: %w", h.path, err)
+	}
+	return h, nil
+}
+
+// add records a use of slug now
+func (h *history) add(slug string) error {
+	h.Uses = append(h.Uses, use{Slug: slug, At: time.Now()})
+	if len(h.Uses) > historyMax {
+		h.Uses = h.Uses[len(h.Uses)-historyMax:]
+	}
+	b, err := json.Marshal(h)
+	if err != nil {
+		return fmt.Errorf("cant marshal history: %w", err)
+	}
+	if err := writeCache(h.path, b); err != nil {
+		return fmt.Errorf("cant write history %s: %w", h.path, err)
+	}
+	return nil
+}
+
+// frecency scores each profile on how often and how lately it's been used
+func (h history) frecency() map[string]int {
+	fs := map[string]int{}
+	for _, u := range h.Uses {
+		age := time.Since(u.At)
+		switch {
+		case age < 4*time.Hour:
+			fs[u.Slug] += 100
+		case age < 24*time.Hour:
+			fs[u.Slug] += 80
+		case age < 7*24*time.Hour:
+			fs[u.Slug] += 60
+		case age < 30*24*time.Hour:
+			fs[u.Slug] += 40
+		default:
+			fs[u.Slug] += 20
+		}
+	}
+	return fs
+}
+
+// order sorts ms by frecency, keeping the order of equals
+func (h history) order(ms []match) {
+	fs := h.frecency()
+	sort.SliceStable(ms, func(i, j int) bool { return fs[ms[i].name] > fs[ms[j].name] })
+}
+
+// favourite is whether the first of ms (sorted by order) is used so much more
+// than the rest that it's the one to pick
+func (h history) favourite(ms []match) bool {
+	if len(ms) < 1 {
+		return false
+	}
+	fs := h.frecency()
+	top := fs[ms[0].name]
+	if top < favouriteMin {
+		return false
+	}
+	return len(ms) == 1 || top >= favouriteRatio*fs[ms[1].name]
+}
+
+// recent is each profile used, most recent first
+func (h history) recent() []use {
+	seen := map[string]bool{}
+	us := []use{}
+	for i := len(h.Uses) - 1; i >= 0; i-- {
+		if !seen[h.Uses[i].Slug] {
+			seen[h.Uses[i].Slug] = true
+			us = append(us, h.Uses[i])
+		}
+	}
+	return us
+}
+
+// ago is a rough, short age like "5m ago"
+func ago(t time.Time) string {
+	d := time.Since(t)
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return fmt.Sprintf("%dm ago", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh ago", int(d.Hours()))
+	}
+	return fmt.Sprintf("%dd ago", int(d.Hours()/24))
+}
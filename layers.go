@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// layers is the config merged from the system config, any included files and
+// the user's config.json, in that order. later files win: objects are merged
+// key by key, instances are merged by name and anything else is replaced
+type layers struct {
+	files   []string          // the files merged, in order
+	merged  map[string]any    // the merged config
+	origins map[string]string // config key paths to the file they came from
+}
+
+// systemConfigPath is the system-wide config shared by everyone on the box,
+// LASH_SYSTEM_CONFIG overrides it
+func systemConfigPath() string {
+	if p := os.Getenv("LASH_SYSTEM_CONFIG"); p != "" {
+		return p
+	}
+	if runtime.GOOS == "windows" {
+		return configIn(filepath.Join(os.Getenv("ProgramData"), "lash"))
+	}
+	return configIn("/etc/lash")
+}
+
+// configIn is the config file in dir, warning about any others it ignores
+func configIn(dir string) string {
+	p, others := findConfig(dir)
+	for _, o := range others {
+		fmt.Fprintf(os.Stderr, "ignoring %s, %s takes precedence\n", o, filepath.Base(p))
+	}
+	return p
+}
+
+// loadLayers merges the system config and the user config in lashdir, along
+// with whatever they include. either may be missing, includes may not
+func loadLayers(lashdir string) (layers, error) {
+	l := layers{merged: map[string]any{}, origins: map[string]string{}}
+	for _, p := range []string{systemConfigPath(), configIn(lashdir)} {
+		if err := l.add(p, map[string]bool{}, false); err != nil {
+			return l, err
+		}
+	}
+	return l, nil
+}
+
+// add merges the file at path after the files it includes. include paths are
+// relative to the including file. stack is the files including this one, a file
+// included again elsewhere (e.g. a team config in both the system and user
+// configs) is just merged again
+func (l *layers) add(path string, stack map[string]bool, required bool) error {
+	path = filepath.Clean(path)
+	if stack[path] {
+		return fmt.Errorf("config %s includes itself", path)
+	}
+	stack[path] = true
+	defer delete(stack, path)
+
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) && !required {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cant open config: %w", err)
+	}
+	m, err := decodeConfig(path, b)
+	if err != nil {
+		return err
+	}
+
+	incs, _ := m["include"].([]any)
+	for _, inc := range incs {
+		p, ok := inc.(string)
+		if !ok {
+			return fmt.Errorf("config %s: include must be a list of paths", path)
+		}
+		if strings.HasPrefix(p, "~/") {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return fmt.Errorf("cant get home directory for include %s: %w", p, err)
+			}
+			p = filepath.Join(home, p[2:])
+		}
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(filepath.Dir(path), p)
+		}
+		if err := l.add(p, stack, true); err != nil {
+			return err
+		}
+	}
+
+	delete(m, "include")
+	l.files = append(l.files, path)
+	mergeInto(l.merged, m, path, "", l.origins)
+	return nil
+}
+
+func mergeInto(dst, src map[string]any, from, path string, origins map[string]string) {
+	for k, v := range src {
+		p := k
+		if path != "" {
+			p = path + "." + k
+		}
+		dm, dok := dst[k].(map[string]any)
+		sm, sok := v.(map[string]any)
+		switch {
+		case dok && sok:
+			mergeInto(dm, sm, from, p, origins)
+		case path == "" && k == "instances":
+			dst[k] = mergeInstances(dst[k], v, from, origins)
+		default:
+			dst[k] = v
+			for o := range origins {
+				if strings.HasPrefix(o, p+".") || strings.HasPrefix(o, p+"[") {
+					delete(origins, o)
+				}
+			}
+			origins[p] = from
+		}
+	}
+}
+
+// mergeInstances replaces instances in dst with same-named ones from src, and
+// adds the rest
+func mergeInstances(dst, src any, from string, origins map[string]string) any {
+	dl, _ := dst.([]any)
+	sl, ok := src.([]any)
+	if !ok { // not a list, let the strict decode complain about it
+		origins["instances"] = from
+		return src
+	}
+	for _, si := range sl {
+		name := instanceKey(si)
+		replaced := false
+		for i, di := range dl {
+			if name != "" && instanceKey(di) == name {
+				dl[i] = si
+				replaced = true
+			}
+		}
+		if !replaced {
+			dl = append(dl, si)
+		}
+		origins["instances["+name+"]"] = from
+	}
+	return dl
+}
+
+func instanceKey(v any) string {
+	m, _ := v.(map[string]any)
+	name, _ := m["name"].(string)
+	return name
+}
+
+// origin is the file a config key path came from, the closest one set
+func (l layers) origin(path string) string {
+	for p := path; p != ""; {
+		if o, ok := l.origins[p]; ok {
+			return o
+		}
+		i := strings.LastIndexAny(p, ".[")
+		if i < 0 {
+			break
+		}
+		p = p[:i]
+	}
+	return ""
+}
+
+// show prints every effective config value with where it came from. env holds
+// the values overridden by LASH_ environment variables and flags the ones
+// overridden by flags, which win
+func (l layers) show(w io.Writer, env, flags map[string]string) {
+	lines := [][2]string{}
+	var walk func(path string, v any)
+	walk = func(path string, v any) {
+		switch vv := v.(type) {
+		case map[string]any:
+			keys := make([]string, 0, len(vv))
+			for k := range vv {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				p := k
+				if path != "" {
+					p = path + "." + k
+				}
+				walk(p, vv[k])
+			}
+		case []any:
+			if path == "instances" {
+				for _, in := range vv {
+					walk("instances["+instanceKey(in)+"]", in)
+				}
+				return
+			}
+			b, _ := json.Marshal(vv)
+			lines = append(lines, [2]string{path + " = " + string(b), l.origin(path)})
+		default:
+			if f, ok := flags[path]; ok {
+				b, _ := json.Marshal(f)
+				lines = append(lines, [2]string{path + " = " + string(b), "-" + flagName(path)})
+				return
+			}
+			if e, ok := env[path]; ok {
+				b, _ := json.Marshal(e)
+				lines = append(lines, [2]string{path + " = " + string(b), "$" + envName(path)})
+				return
+			}
+			b, _ := json.Marshal(vv)
+			lines = append(lines, [2]string{path + " = " + string(b), l.origin(path)})
+		}
+	}
+
+	merged := map[string]any{}
+	for k, v := range l.merged {
+		merged[k] = v
+	}
+	for _, over := range []map[string]string{env, flags} { // values that aren't in any file
+		for k := range over {
+			if _, ok := merged[k]; !ok {
+				merged[k] = over[k]
+			}
+		}
+	}
+	walk("", merged)
+
+	width := 0
+	for _, line := range lines {
+		if len(line[0]) > width {
+			width = len(line[0])
+		}
+	}
+	for _, line := range lines {
+		fmt.Fprintf(w, "%-*s  %s\n", width, line[0], line[1])
+	}
+}
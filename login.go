@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssooidc"
+	"github.com/pkg/browser"
+	"rsc.io/qr"
+)
+
+// redirectURI is registered without a port, the loopback listener picks a free
+// one for each login and identity center accepts any port on 127.0.0.1
+const redirectURI = "http://127.0.0.1/oauth/callback"
+
+// how long to wait for the browser to come back with the code
+const codeTimeout = 10 * time.Minute
+
+// errLoginTimeout is when the browser never comes back with a code. a rejected
+// client registration can leave the browser stuck on an error page, so the
+// registration isnt trusted after this
+var errLoginTimeout = errors.New("timed out waiting for the browser login, the client will register again next time")
+
+// authError is an oauth error sent back to the redirect instead of a code
+type authError struct {
+	code string
+	desc string
+}
+
+func (e authError) Error() string {
+	return fmt.Sprintf("login failed: %s %s", e.code, e.desc)
+}
+
+type callback struct {
+	code string
+	err  error
+}
+
+// authCode logs in with the authorization code grant and pkce. a short-lived
+// listener on 127.0.0.1 receives the redirect from the browser and the code is
+// swapped for a token
+func (t *token) authCode(ctx context.Context, cfg config, oidc *ssooidc.Client) (*ssooidc.CreateTokenOutput, error) {
+	verifier, err := randString(32)
+	if err != nil {
+		return nil, fmt.Errorf("cant make pkce verifier: %w", err)
+	}
+	state, err := randString(16)
+	if err != nil {
+		return nil, fmt.Errorf("cant make oauth state: %w", err)
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("cant start redirect listener: %w", err)
+	}
+	redirect := fmt.Sprintf("http://127.0.0.1:%d/oauth/callback", ln.Addr().(*net.TCPAddr).Port)
+
+	cbs := make(chan callback, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth/callback", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("state") != state {
+			http.Error(w, "lash: state mismatch, ignoring this redirect", http.StatusBadRequest)
+			return
+		}
+		cb := callback{code: q.Get("code")}
+		switch {
+		case q.Get("error") != "":
+			cb.err = authError{code: q.Get("error"), desc: q.Get("error_description")}
+			http.Error(w, "lash: login failed, check the terminal", http.StatusBadRequest)
+		case cb.code == "":
+			cb.err = errors.New("login failed: no code in the redirect")
+			http.Error(w, "lash: login failed, check the terminal", http.StatusBadRequest)
+		default:
+			fmt.Fprintln(w, "lash: logged in, you can close this tab")
+		}
+		select {
+		case cbs <- cb:
+		default: // already got one
+		}
+	})
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() { _ = srv.Serve(ln) }()
+	defer func() { _ = srv.Close() }()
+
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", t.client.ID)
+	q.Set("redirect_uri", redirect)
+	q.Set("state", state)
+	q.Set("code_challenge_method", "S256")
+	q.Set("code_challenge", challenge)
+	q.Set("scopes", ssoScope)
+	authurl := cfg.authorizeURL() + "?" + q.Encode()
+
+	browse(cfg.Browser, authurl)
+	fmt.Fprintln(os.Stderr, "waiting for the login to be approved in the browser (ctrl-c to give up)")
+
+	var cb callback
+	select {
+	case cb = <-cbs:
+	case <-ctx.Done():
+		return nil, errors.New("login cancelled")
+	case <-time.After(codeTimeout):
+		return nil, errLoginTimeout
+	}
+	if cb.err != nil {
+		return nil, cb.err
+	}
+
+	tok, err := oidc.CreateToken(
+		ctx,
+		&ssooidc.CreateTokenInput{
+			ClientId:     aws.String(t.client.ID),
+			ClientSecret: aws.String(t.client.Secret),
+			GrantType:    aws.String(grantCode),
+			Code:         aws.String(cb.code),
+			CodeVerifier: aws.String(verifier),
+			RedirectUri:  aws.String(redirect),
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("cant create token: %w", err)
+	}
+	return tok, nil
+}
+
+// browse opens the login pages, the tests swap it for an http client
+var browse = openURL
+
+// randString is n random bytes, base64url encoded without padding
+func randString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// openURL opens u with the browser command, or the system default browser
+// when there isn't one. if that fails u is printed instead
+func openURL(command, u string) {
+	var err error
+	if command != "" {
+		err = runBrowser(command, u)
+	} else {
+		err = browser.OpenURL(u)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cant open a browser (%v), open this url to continue:\n  %s\n", err, u)
+	}
+}
+
+// runBrowser starts the browser command with {url} replaced by u, or with u
+// as the last argument. it doesn't wait around for the browser to exit
+func runBrowser(command, u string) error {
+	args := splitCommand(command)
+	if len(args) < 1 {
+		return errors.New("empty browser command")
+	}
+	found := false
+	for i, a := range args {
+		if strings.Contains(a, "{url}") {
+			args[i] = strings.ReplaceAll(a, "{url}", u)
+			found = true
+		}
+	}
+	if !found {
+		args = append(args, u)
+	}
+
+	/* #nosec */
+	cmd := exec.Command(args[0], args[1:]...)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	return cmd.Process.Release()
+}
+
+// splitCommand splits s into words on spaces, like a (very) simple shell:
+// single or double quotes keep spaces in a word, there are no escapes
+func splitCommand(s string) []string {
+	var words []string
+	var w strings.Builder
+	var quote rune
+	inword := false
+	for _, r := range s {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			w.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote = r
+			inword = true
+		case r == ' ' || r == '\t':
+			if inword {
+				words = append(words, w.String())
+				w.Reset()
+				inword = false
+			}
+		default:
+			w.WriteRune(r)
+			inword = true
+		}
+	}
+	if inword {
+		words = append(words, w.String())
+	}
+	return words
+}
+
+// showCode prints the device login url and user code for a headless login,
+// and optionally the url as a qr code to scan with a phone
+func showCode(auth *ssooidc.StartDeviceAuthorizationOutput, withqr bool) {
+	fmt.Fprintf(os.Stderr, "open this url in a browser to log in:\n  %s\n", aws.ToString(auth.VerificationUriComplete))
+	fmt.Fprintf(os.Stderr, "and check it shows this code: %s\n", aws.ToString(auth.UserCode))
+	if !withqr {
+		return
+	}
+	code, err := qr.Encode(aws.ToString(auth.VerificationUriComplete), qr.L)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cant draw qr code: %v\n", err)
+		return
+	}
+	fmt.Fprint(os.Stderr, qrText(code))
+}
+
+// qrText draws code with half block characters, two rows of modules to a line
+// of text. light modules are drawn, so it's drawn white on black with a quiet
+// zone around it to read on any terminal
+func qrText(code *qr.Code) string {
+	const quiet = 2
+	var b strings.Builder
+	for y := -quiet; y < code.Size+quiet; y += 2 {
+		b.WriteString(cQR)
+		for x := -quiet; x < code.Size+quiet; x++ {
+			top, bot := !code.Black(x, y), !code.Black(x, y+1)
+			if y+1 >= code.Size+quiet {
+				bot = false
+			}
+			switch {
+			case top && bot:
+				b.WriteString("█")
+			case top:
+				b.WriteString("▀")
+			case bot:
+				b.WriteString("▄")
+			default:
+				b.WriteString(" ")
+			}
+		}
+		b.WriteString(cReset + "\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// TestAuthCode logs in against a stand-in oidc server: register the client,
+// follow /authorize back to the loopback listener and swap the code for a token
+func TestAuthCode(t *testing.T) {
+	var challenge, redirect string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/client/register", func(w http.ResponseWriter, r *http.Request) {
+		var reg struct {
+			GrantTypes   []string `json:"grantTypes"`
+			RedirectUris []string `json:"redirectUris"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&reg)
+		if !in(reg.GrantTypes, grantCode) || !in(reg.RedirectUris, redirectURI) {
+			t.Errorf("register: want the code grant and %s, got %v %v", redirectURI, reg.GrantTypes, reg.RedirectUris)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"clientId": "cid", "clientSecret": "csec", "clientSecretExpiresAt": 4102444800})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("response_type") != "code" || q.Get("client_id") != "cid" || q.Get("code_challenge_method") != "S256" {
+			t.Errorf("authorize: bad query %v", q)
+		}
+		challenge, redirect = q.Get("code_challenge"), q.Get("redirect_uri")
+		u, err := url.Parse(redirect)
+		if err != nil || u.Hostname() != "127.0.0.1" || u.Port() == "" || u.Path != "/oauth/callback" {
+			t.Errorf("authorize: redirect_uri %q isnt the loopback listener", redirect)
+		}
+		http.Redirect(w, r, redirect+"?code=the-code&state="+url.QueryEscape(q.Get("state")), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		var in struct {
+			GrantType    string `json:"grantType"`
+			Code         string `json:"code"`
+			CodeVerifier string `json:"codeVerifier"`
+			RedirectURI  string `json:"redirectUri"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&in)
+		sum := sha256.Sum256([]byte(in.CodeVerifier))
+		switch {
+		case in.GrantType != grantCode || in.Code != "the-code":
+			t.Errorf("token: want the code grant with the-code, got %q %q", in.GrantType, in.Code)
+		case base64.RawURLEncoding.EncodeToString(sum[:]) != challenge:
+			t.Errorf("token: verifier %q doesnt match challenge %q", in.CodeVerifier, challenge)
+		case in.RedirectURI != redirect:
+			t.Errorf("token: redirect_uri %q, want %q from authorize", in.RedirectURI, redirect)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"accessToken": "at", "expiresIn": 3600, "refreshToken": "rt", "tokenType": "Bearer"})
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	// the browser: a forged redirect with the wrong state first, then the
+	// real login
+	defer func(b func(string, string)) { browse = b }(browse)
+	browse = func(_, authurl string) {
+		u, _ := url.Parse(authurl)
+		cb := u.Query().Get("redirect_uri")
+		resp, err := http.Get(cb + "?code=forged&state=wrong")
+		if err != nil {
+			t.Errorf("forged redirect: %v", err)
+			return
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("forged redirect: got %d, want the state check to reject it", resp.StatusCode)
+		}
+
+		resp, err = http.Get(authurl)
+		if err != nil {
+			t.Errorf("login: %v", err)
+			return
+		}
+		_ = resp.Body.Close()
+	}
+
+	cfg := config{
+		cachedir:     t.TempDir(),
+		Region:       "us-east-1",
+		StartURL:     "https://example.awsapps.com/start",
+		OIDCEndpoint: srv.URL,
+	}
+	tok := newToken(cfg)
+	oidc := cfg.oidc()
+	if err := tok.client.register(oidc, flowCode, cfg.StartURL); err != nil {
+		t.Fatal(err)
+	}
+	out, err := tok.authCode(context.Background(), cfg, oidc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := *out.AccessToken; got != "at" {
+		t.Errorf("access token %q, want at", got)
+	}
+	if !strings.HasPrefix(redirect, "http://127.0.0.1:") {
+		t.Errorf("redirect_uri %q has no port", redirect)
+	}
+}
@@ -12,7 +12,10 @@ import (
 	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"sort"
 	"strconv"
@@ -28,49 +31,132 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/sso"
 	typ "github.com/aws/aws-sdk-go-v2/service/sso/types"
 	"github.com/aws/aws-sdk-go-v2/service/ssooidc"
-	"github.com/pkg/browser"
+	otyp "github.com/aws/aws-sdk-go-v2/service/ssooidc/types"
+	"golang.org/x/term"
 )
 
 var version = "edge"
 
+const (
+	grantCode    = "authorization_code"
+	grantDevice  = "urn:ietf:params:oauth:grant-type:device_code"
+	grantRefresh = "refresh_token"
+	ssoScope     = "sso:account:access"
+
+	flowCode   = "code"
+	flowDevice = "device"
+
+	defaultInstance = "default" // the name of the top-level sso instance
+)
+
 type config struct {
-	basedir string
+	basedir  string
+	cachedir string // lash/ in the basedir, or a subdirectory for an instance
+	name     string // the sso instance name
+	prefix   string // the sso instance profile name prefix
+	headless bool   // no browser to pop, print the login url instead
+	qr       bool   // draw the login url as a qr code when headless
+
+	Region          string            `json:"region,omitempty"`
+	StartURL        string            `json:"start_url,omitempty"`
+	RoleStripPrefix string            `json:"role_strip_prefix,omitempty"`
+	RoleStripSuffix string            `json:"role_strip_suffix,omitempty"`
+	StripPrefix     string            `json:"strip_prefix,omitempty"`
+	StripSuffix     string            `json:"strip_suffix,omitempty"`
+	AccountRewrite  rewrites          `json:"account_rewrite,omitempty"`
+	RoleRewrite     rewrites          `json:"role_rewrite,omitempty"`
+	Filter          *filter           `json:"filter,omitempty"`
+	RolePreference  []string          `json:"role_preference,omitempty"`
+	Nicks           map[string]string `json:"nicks,omitempty"`
+	Login           string            `json:"login,omitempty"`
+	OIDCEndpoint    string            `json:"oidc_endpoint,omitempty"`
+	CLICache        bool              `json:"cli_cache,omitempty"`
+	SSOSession      string            `json:"sso_session,omitempty"`
+	ExpiryMargin    string            `json:"expiry_margin,omitempty"`
+	Browser         string            `json:"browser,omitempty"`
+	Include         []string          `json:"include,omitempty"`
+
+	Profiles  map[string]profileSettings `json:"profiles,omitempty"`
+	Instances []instance                 `json:"instances,omitempty"`
+
+	margin time.Duration // parsed ExpiryMargin
+}
+
+// instance is an extra sso instance (start url) used alongside the top-level
+// one. empty strip and rewrite settings are inherited from the top-level config
+type instance struct {
+	Name            string `json:"name,omitempty"`
+	Region          string `json:"region,omitempty"`
+	StartURL        string `json:"start_url,omitempty"`
+	SSOSession      string `json:"sso_session,omitempty"`
+	Prefix          string `json:"prefix,omitempty"`
+	RoleStripPrefix string `json:"role_strip_prefix,omitempty"`
+	RoleStripSuffix string `json:"role_strip_suffix,omitempty"`
+	StripPrefix     string `json:"strip_prefix,omitempty"`
+	StripSuffix     string `json:"strip_suffix,omitempty"`
+
+	AccountRewrite rewrites `json:"account_rewrite,omitempty"`
+	RoleRewrite    rewrites `json:"role_rewrite,omitempty"`
+}
 
-	Region          string            `json:"region"`
-	StartURL        string            `json:"start_url"`
-	RoleStripPrefix string            `json:"role_strip_prefix"`
-	RoleStripSuffix string            `json:"role_strip_suffix"`
-	StripPrefix     string            `json:"strip_prefix"`
-	StripSuffix     string            `json:"strip_suffix"`
-	Nicks           map[string]string `json:"nicks"`
+// profileSettings are the config settings for a single profile, or for the
+// profiles matching a glob
+type profileSettings struct {
+	Browser     string            `json:"browser,omitempty"`     // for console urls
+	Region      string            `json:"region,omitempty"`      // the default region for the creds
+	Env         map[string]string `json:"env,omitempty"`         // extra environment for the command shim
+	Destination string            `json:"destination,omitempty"` // the console page to land on
+	Tags        []string          `json:"tags,omitempty"`        // shown beside the profile in listings
 }
 
 type token struct {
+	path     string
+	client   client
+	margin   time.Duration // treat the token as expired this much early
+	cli      bool          // path is in the aws cli v2 sso cache, and in its format
+	region   string        // for the aws cli format
+	starturl string        // for the aws cli format
+
+	Value        string
+	IssuedAt     time.Time
+	ExpiresAt    time.Time
+	ExpiresIn    int `json:",omitempty"` // only in caches from before ExpiresAt
+	RefreshToken string
+}
+
+// client is the oidc client registration, kept so the refresh token can be
+// redeemed later (refresh tokens are bound to the client that asked for them)
+type client struct {
 	path string
 
-	Value     string
-	ExpiresIn int
+	ID        string
+	Secret    string
+	ExpiresAt int64  // unix seconds
+	Flow      string // the login flow it was registered for
 }
 
+// account is cached as sso has it, names are slugified from the current config
+// each time the profiles are loaded
 type account struct {
 	Name  string
-	Slug  string
 	ID    string
 	Roles []string
 }
 
 type profile struct {
-	path   string
-	token  string
-	region string
-	badges map[string]badge
+	path  string
+	token token
+	cfg   config // the config for the profile's sso instance
 
 	Accounts []account
 }
 
 type badge struct {
-	id   string // account id
-	role string // role name
+	id   string   // account id
+	acct string   // account slug
+	role string   // role name
+	base string   // the profile name before it's qualified to tell it apart
+	p    *profile // the sso instance it's from
 }
 
 type sessionToken struct {
@@ -91,14 +177,38 @@ func main() {
 	}
 
 	// flags
-	fbasedir := flag.String("d", filepath.Join(homedir, ".aws"), "the directory with the credentials file and lash/ subdir")
+	basedir := os.Getenv("LASH_DIR")
+	if basedir == "" {
+		basedir = filepath.Join(homedir, ".aws")
+	}
+	fall := flag.Bool("a", false, "show all profiles, including the ones hidden by the config filter")
+	fbasedir := flag.String("d", basedir, "the directory with the credentials file and lash/ subdir")
+	fformat := flag.String("format", "", "with -init, write the config as json, yaml or toml")
 	fhelp := flag.Bool("h", false, "show help")
-	finit := flag.Bool("init", false, "make the lash sub-directory and re-create the config.json file")
-	fnonick := flag.Bool("n", false, "disable nicknames")
+	fshowcfg := flag.Bool("config", false, "show the effective config and which file each value came from")
+	fheadless := flag.Bool("headless", envBool("LASH_HEADLESS"), "print the login url and code instead of opening a browser")
+	finit := flag.Bool("init", false, "make the lash sub-directory and config file, or update the keys given in it")
+	flogout := flag.Bool("logout", false, "end the sso session and delete the lash caches")
+	fnonick := flag.Bool("n", envBool("LASH_NO_NICKS"), "disable nicknames")
+	fopen := flag.Bool("o", false, "open an aws console url for the chosen role in the browser")
+	fpurge := flag.Bool("purge", false, "like -logout, and also remove the managed creds from the credentials file")
+	frecent := flag.Bool("recent", false, "list recently used profiles, and dont pick a profile from history")
+	fqr := flag.Bool("qr", false, "headless, and draw the login url as a qr code")
 	frefresh := flag.Bool("r", false, "refresh caches (token and profiles)")
+	fstatus := flag.Bool("s", false, "show how long the sso session has left")
 	furl := flag.Bool("u", false, "generate an aws console url for the chosen role")
 	fver := flag.Bool("v", false, "print program version")
+	fsets := map[string]*string{}
+	for _, k := range settable {
+		fsets[k] = flag.String(flagName(k), "", "override "+k+" from the config, or with -init set it in the config")
+	}
 	flag.Parse()
+	flags := map[string]string{} // the settable keys given as flags
+	for _, k := range settable {
+		if v := *fsets[k]; v != "" {
+			flags[k] = v
+		}
+	}
 
 	if *fhelp {
 		fmt.Print(usageTop)
@@ -130,34 +240,113 @@ func main() {
 	}
 
 	if *finit {
-		if err := setup(*fbasedir); err != nil {
+		vals := map[string]string{}
+		for _, k := range settable {
+			if v, ok := flags[k]; ok {
+				vals[k] = v
+			} else if v := os.Getenv(initEnvName(k)); v != "" {
+				vals[k] = v
+			}
+		}
+		if err := setup(*fbasedir, vals, *fformat); err != nil {
 			fmt.Fprintf(os.Stderr, "cant create config: %v\n", err)
 			os.Exit(3)
 		}
+		if !interactive() { // provisioning from a script, dont go on to log in
+			os.Exit(0)
+		}
+	}
+
+	if *fshowcfg {
+		l, err := loadLayers(filepath.Join(*fbasedir, "lash"))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cant load config: %v\n", err)
+			os.Exit(2)
+		}
+		env := map[string]string{}
+		for _, k := range settable {
+			if v := os.Getenv(envName(k)); v != "" {
+				env[k] = v
+			}
+		}
+		l.show(os.Stdout, env, flags)
+		os.Exit(0)
 	}
 
-	cfg, err := loadConfig(*fbasedir)
+	cfg, err := loadConfig(*fbasedir, flags)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "cant load config: %v\n", err)
 		os.Exit(2)
 	}
+	cfg.headless = *fheadless || *fqr
+	if !flagSet("headless") && os.Getenv("LASH_HEADLESS") == "" { // not told either way, guess
+		cfg.headless = cfg.headless || headless()
+	}
+	cfg.qr = *fqr
+
+	if *flogout || *fpurge {
+		for _, icfg := range cfg.instances() {
+			if err := logout(icfg); err != nil {
+				fmt.Fprintf(os.Stderr, "cant log out%s: %v\n", icfg.label(), err)
+				os.Exit(4)
+			}
+		}
+		if *fpurge {
+			if err := os.Remove(filepath.Join(cfg.cachedir, "history.json")); err != nil && !os.IsNotExist(err) {
+				fmt.Fprintf(os.Stderr, "cant remove history: %v\n", err)
+				os.Exit(4)
+			}
+			if err := writeCreds(cfg, nil); err != nil {
+				fmt.Fprintf(os.Stderr, "cant write creds file: %v\n", err)
+				os.Exit(6)
+			}
+		}
+		os.Exit(0)
+	}
 
-	p, err := getProfile(cfg, *frefresh)
+	if *fstatus {
+		for _, icfg := range cfg.instances() {
+			if err := status(icfg); err != nil {
+				fmt.Fprintf(os.Stderr, "cant get sso session status%s: %v\n", icfg.label(), err)
+				os.Exit(4)
+			}
+		}
+		os.Exit(0)
+	}
+
+	hist, err := loadHistory(cfg)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "cant get profile: %v\n", err)
-		os.Exit(4)
+		fmt.Fprintf(os.Stderr, "not using history: %v\n", err)
+	}
+	if *frecent && choice == "" {
+		us := hist.recent()
+		width := 0
+		for _, u := range us {
+			if len(u.Slug) > width {
+				width = len(u.Slug)
+			}
+		}
+		for _, u := range us {
+			fmt.Printf("  %-*s  %s\n", width, u.Slug, ago(u.At))
+		}
+		os.Exit(0)
 	}
 
-	p.badges = map[string]badge{}
-	for _, a := range p.Accounts {
-		for _, r := range a.Roles {
-			role := strings.TrimPrefix(r, cfg.RoleStripPrefix)
-			role = strings.TrimSuffix(a.Slug+"-"+role, cfg.RoleStripSuffix)
-			p.badges[role] = badge{id: a.ID, role: r}
+	ps := []*profile{}
+	for _, icfg := range cfg.instances() {
+		p, err := getProfile(icfg, *frefresh)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cant get profile%s: %v\n", icfg.label(), err)
+			continue
 		}
+		ps = append(ps, &p)
+	}
+	if len(ps) < 1 {
+		os.Exit(4)
 	}
+	badges := makeBadges(ps, *fall)
 
-	fromnick := false
+	fromnick, fromhist, frompref := false, false, false
 	if !*fnonick {
 		if _, ok := cfg.Nicks[choice]; ok {
 			choice = cfg.Nicks[choice]
@@ -165,29 +354,70 @@ func main() {
 		}
 	}
 
-	if _, ok := p.badges[choice]; !ok { // there's no full-match for this choice
-		matches := []string{}
+	if _, ok := badges[choice]; !ok { // there's no full-match for this choice
 		roles := []string{}
-		for role := range p.badges {
+		for role := range badges {
 			roles = append(roles, role)
-			if strings.Contains(role, choice) {
-				matches = append(matches, role)
-			}
 		}
-		if len(matches) == 1 {
-			choice = matches[0]
+		sort.Strings(roles)
+		matches := []string{}
+		ranked := rankMatches(choice, badges)
+		if choice != "" && clearWinner(ranked) {
+			choice = ranked[0].name
 			goto fuzzy // 1985 coming at you hard
 		}
-		sort.Strings(roles)
+		ncontend := 0 // the contenders, near enough the best
+		for ncontend < len(ranked) && ranked[ncontend].score > ranked[0].score-clearMargin {
+			ncontend++
+		}
+		if pref, ok := preferred(cfg.RolePreference, ranked[:ncontend], badges); choice != "" && ok {
+			choice = pref
+			frompref = true
+			goto fuzzy
+		}
+		hist.order(ranked[:ncontend])
+		if choice != "" && !*frecent && hist.favourite(ranked[:ncontend]) {
+			choice = ranked[0].name
+			fromhist = true
+			goto fuzzy
+		}
+		if pickable() {
+			picked, ok, err := pick(cfg, choice, badges, hist)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "cant run the picker: %v\n", err)
+				os.Exit(11)
+			}
+			if !ok {
+				fmt.Fprintln(os.Stderr, "no profile picked")
+				os.Exit(11)
+			}
+			choice = picked
+			goto fuzzy
+		}
+		if choice != "" {
+			for _, m := range ranked { // best matches first, then the rest
+				matches = append(matches, m.name)
+			}
+			for _, role := range roles {
+				if !in(matches, role) {
+					matches = append(matches, role)
+				}
+			}
+			roles, matches = matches, matches[:ncontend]
+		}
 		msg := "available roles:"
 		if choice == "" {
 			msg = "use one of the following roles:"
 		}
 		fmt.Fprintln(os.Stderr, msg)
 		for _, role := range roles {
-			line := "      " + role
+			label := role
+			if tags := cfg.settingsFor(role, badges[role]).Tags; len(tags) > 0 {
+				label += "  [" + strings.Join(tags, " ") + "]"
+			}
+			line := "      " + label
 			if choice != "" && in(matches, role) {
-				line = cGreen + "  ~>  " + role + cReset
+				line = cGreen + "  ~>  " + label + cReset
 			}
 			fmt.Println(line)
 		}
@@ -208,15 +438,32 @@ fuzzy:
 	if fromnick {
 		selmsg = "selected (via nicks): "
 	}
+	if fromhist {
+		selmsg = "selected (most used): "
+	}
+	if frompref {
+		selmsg = "selected (preferred role " + badges[choice].role + "): "
+	}
 	fmt.Fprintln(os.Stderr, selmsg+choice)
 
-	keys, err := p.getKeys(choice)
+	b := badges[choice]
+	settings := cfg.settingsFor(choice, b)
+	keys, err := b.getKeys(choice)
+	if unauthorized(err) {
+		fmt.Fprintln(os.Stderr, "sso rejected the token, logging in again")
+		if err = b.p.token.relogin(b.p.cfg); err == nil {
+			keys, err = b.getKeys(choice)
+		}
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "cant get keys for %s: %v\n", choice, err)
 		os.Exit(5)
 	}
+	if err := hist.add(choice); err != nil {
+		fmt.Fprintf(os.Stderr, "not saving history: %v\n", err)
+	}
 
-	if *furl {
+	if *furl || *fopen {
 		fedUrl := "https://signin.aws.amazon.com/federation"
 		t := sessionToken{
 			SessionID:    keys["AccessKeyId"],
@@ -272,15 +519,20 @@ fuzzy:
 		}
 		qs := u.Query()
 		qs.Set("SigninToken", signinToken)
-		qs.Set("Destination", "https://console.aws.amazon.com/")
+		qs.Set("Destination", settings.destination())
 		qs.Set("Action", "login")
 		u.RawQuery = qs.Encode()
+		if *fopen {
+			openURL(settings.Browser, u.String())
+			os.Exit(0)
+		}
 		fmt.Println(u.String())
 		os.Exit(0)
 	}
 
 	// write the credentials file and exit zero
 	if cmd == "" {
+		keys["Region"] = settings.Region
 		if err := writeCreds(cfg, keys); err != nil {
 			fmt.Fprintf(os.Stderr, "cant write creds file: %v\n", err)
 			os.Exit(6)
@@ -294,6 +546,13 @@ fuzzy:
 	_ = os.Setenv("AWS_SESSION_TOKEN", keys["SessionToken"])
 	_ = os.Setenv("AWS_SESSION_EXPIRATION", keys["Expiration"])
 	_ = os.Setenv("AWS_PROFILE_NAME", choice)
+	if settings.Region != "" {
+		_ = os.Setenv("AWS_REGION", settings.Region)
+		_ = os.Setenv("AWS_DEFAULT_REGION", settings.Region)
+	}
+	for k, v := range settings.Env {
+		_ = os.Setenv(k, v)
+	}
 
 	/* #nosec */
 	if err := syscall.Exec(cmd, flag.Args()[1:], os.Environ()); err != nil {
@@ -305,18 +564,23 @@ fuzzy:
 
 func getProfile(cfg config, refresh bool) (profile, error) {
 	p := profile{
-		path:   filepath.Join(cfg.basedir, "lash", "profile.json"),
-		region: cfg.Region,
+		path: filepath.Join(cfg.cachedir, "profile.json"),
+		cfg:  cfg,
 	}
 
 	// get the oidc token and write the cache if a new one is generated
-	t := token{path: filepath.Join(cfg.basedir, "lash", "oidc.json")}
+	t := newToken(cfg)
 	if refresh {
 		_ = os.Remove(t.path)
 	}
 	if err := t.getCache(); err != nil {
 		return p, fmt.Errorf("cant get oidc token: %w", err)
 	}
+	if t.Value == "" && t.RefreshToken != "" { // expired, try to renew quietly
+		if err := t.refresh(cfg); err != nil {
+			return p, fmt.Errorf("cant renew oidc token: %w", err)
+		}
+	}
 	if t.Value == "" { // no token cache or expired
 		err := t.create(cfg)
 		if err != nil {
@@ -328,7 +592,7 @@ func getProfile(cfg config, refresh bool) (profile, error) {
 	}
 
 	// get the roles for each account and store them in profile.Accounts
-	p.token = t.Value
+	p.token = t
 	if refresh {
 		_ = os.Remove(p.path)
 	}
@@ -337,6 +601,12 @@ func getProfile(cfg config, refresh bool) (profile, error) {
 	}
 	if len(p.Accounts) < 1 {
 		err := p.create(cfg)
+		if unauthorized(err) {
+			fmt.Fprintln(os.Stderr, "sso rejected the token, logging in again")
+			if err = p.token.relogin(cfg); err == nil {
+				err = p.create(cfg)
+			}
+		}
 		if err != nil {
 			return p, fmt.Errorf("cant get accounts or roles: %w", err)
 		}
@@ -345,8 +615,190 @@ func getProfile(cfg config, refresh bool) (profile, error) {
 	return p, nil
 }
 
+// makeBadges names every role in every sso instance, leaving out the ones the
+// filter hides unless all is set. a name that turns up for more than one
+// account in an instance is qualified with the account id, and one in more
+// than one instance with the instance name, to tell them apart
+func makeBadges(ps []*profile, all bool) map[string]badge {
+	byname := map[string][]badge{}
+	for _, p := range ps {
+		for _, a := range p.Accounts {
+			slug := slugify(p.cfg.AccountRewrite.apply(a.Name), p.cfg.StripPrefix, p.cfg.StripSuffix)
+			for _, r := range a.Roles {
+				if !all && !p.cfg.Filter.shows(a, r) {
+					continue
+				}
+				role := strings.TrimPrefix(p.cfg.RoleRewrite.apply(r), p.cfg.RoleStripPrefix)
+				role = strings.TrimSuffix(slug+"-"+role, p.cfg.RoleStripSuffix)
+				name := p.cfg.prefix + role
+				byname[name] = append(byname[name], badge{id: a.ID, acct: slug, role: r, base: name, p: p})
+			}
+		}
+	}
+
+	badges := map[string]badge{}
+	accts, insts := []string{}, []string{}
+	for name, bs := range byname {
+		if len(bs) == 1 {
+			badges[name] = bs[0]
+			continue
+		}
+		// accounts come back in whatever order, so sort them to name them the
+		// same way every time
+		sort.Slice(bs, func(i, j int) bool {
+			switch {
+			case bs[i].p.cfg.name != bs[j].p.cfg.name:
+				return bs[i].p.cfg.name < bs[j].p.cfg.name
+			case bs[i].id != bs[j].id:
+				return bs[i].id < bs[j].id
+			}
+			return bs[i].role < bs[j].role
+		})
+		multi := bs[0].p != bs[len(bs)-1].p
+		clash := false
+		for i, b := range bs {
+			q := name
+			for j, o := range bs {
+				if j != i && o.p == b.p {
+					q = qualifier(bs, i) + "/" + name
+					clash = true
+					break
+				}
+			}
+			if multi {
+				q = b.p.cfg.name + "/" + q
+			}
+			badges[q] = b
+		}
+		if clash {
+			accts = append(accts, name)
+		}
+		if multi {
+			insts = append(insts, name)
+		}
+	}
+	if len(accts) > 0 {
+		sort.Strings(accts)
+		fmt.Fprintf(os.Stderr, "profile names for more than one account are prefixed with the account id: %s\n", strings.Join(accts, ", "))
+		fmt.Fprintln(os.Stderr, "use account_rewrite in the config to give the accounts different names")
+	}
+	if len(insts) > 0 {
+		sort.Strings(insts)
+		fmt.Fprintf(os.Stderr, "profile names in more than one sso instance are prefixed with the instance name: %s\n", strings.Join(insts, ", "))
+		fmt.Fprintln(os.Stderr, "set a prefix on the instances in the config to avoid this")
+	}
+	return badges
+}
+
+// qualifier tells bs[i] apart from the other badges with its name in its
+// instance: the account id, and the role too if role_rewrite gave two roles in
+// the account the same name
+func qualifier(bs []badge, i int) string {
+	for j, o := range bs {
+		if j != i && o.p == bs[i].p && o.id == bs[i].id {
+			return bs[i].id + "-" + strings.ToLower(bs[i].role)
+		}
+	}
+	return bs[i].id
+}
+
+func newToken(cfg config) token {
+	t := token{
+		path:   filepath.Join(cfg.cachedir, "oidc.json"),
+		client: client{path: filepath.Join(cfg.cachedir, "client.json")},
+		margin: cfg.margin,
+	}
+	if cfg.CLICache { // share the token with aws cli v2
+		t.path = cfg.cliCachePath()
+		t.cli = true
+		t.region = cfg.Region
+		t.starturl = cfg.StartURL
+	}
+	return t
+}
+
+// status prints how long the cached sso token has left
+func status(cfg config) error {
+	t := newToken(cfg)
+	if err := t.getCache(); err != nil {
+		return err
+	}
+	if t.ExpiresAt.IsZero() {
+		fmt.Printf("not logged in to %s\n", cfg.StartURL)
+		return nil
+	}
+
+	fmt.Printf("sso session for %s\n", cfg.StartURL)
+	if !t.IssuedAt.IsZero() {
+		fmt.Printf("  logged in   %s\n", t.IssuedAt.Local().Format(time.RFC1123))
+	}
+	left := time.Until(t.ExpiresAt).Round(time.Second)
+	if left > 0 {
+		fmt.Printf("  expires     %s (%s left)\n", t.ExpiresAt.Local().Format(time.RFC1123), left)
+	} else {
+		fmt.Printf("  expired     %s\n", t.ExpiresAt.Local().Format(time.RFC1123))
+	}
+	if t.RefreshToken != "" {
+		fmt.Println("  renewable   yes, without the browser (until the sso session ends)")
+	}
+	return nil
+}
+
+// logout revokes the sso session, if there is one, and deletes the caches
+func logout(cfg config) error {
+	t := newToken(cfg)
+	t.margin = 0
+	if err := t.getCache(); err != nil {
+		fmt.Fprintf(os.Stderr, "cant read token, not revoking it: %v\n", err)
+	}
+	if t.Value == "" && t.RefreshToken != "" { // the sso session outlives the access token
+		if err := t.refresh(cfg); err != nil {
+			fmt.Fprintf(os.Stderr, "cant refresh token to revoke the sso session: %v\n", err)
+		}
+	}
+	live := false // the sso session may still be live
+	switch {
+	case t.Value != "":
+		ssoc := sso.New(sso.Options{Region: cfg.Region})
+		_, err := ssoc.Logout(context.Background(), &sso.LogoutInput{AccessToken: aws.String(t.Value)})
+		switch {
+		case err == nil:
+		case unauthorized(err) && t.RefreshToken == "": // it's already dead
+		case unauthorized(err): // the refresh token says otherwise
+			fmt.Fprintln(os.Stderr, "sso rejected the token, cant revoke the sso session")
+			live = true
+		default:
+			fmt.Fprintf(os.Stderr, "cant revoke sso session, deleting caches anyway: %v\n", err)
+			live = true
+		}
+	case t.RefreshToken != "": // the client registration expired, so no refresh
+		fmt.Fprintln(os.Stderr, "cant get a token to revoke the sso session with")
+		live = true
+	}
+
+	var rmerr error
+	for _, path := range cfg.caches() {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "cant delete %s: %v\n", path, err)
+			rmerr = errors.New("some caches are left behind")
+		}
+	}
+	if rmerr != nil {
+		return rmerr
+	}
+	if live {
+		fmt.Fprintln(os.Stderr, "deleted the caches, but the sso session may still be live: sign out of the aws access portal to end it")
+		return nil
+	}
+	fmt.Fprintln(os.Stderr, "logged out")
+	return nil
+}
+
+// writeCreds writes the keys as the default profile in the credentials file,
+// between the unmanaged head and tail. with no keys it writes just the head and
+// tail, dropping the managed profile
 func writeCreds(cfg config, keys map[string]string) error {
-	cfp := filepath.Join(cfg.basedir, "credentials")
+	cfp := cfg.credsPath()
 
 	cf, err := os.OpenFile(filepath.Clean(cfp), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
 	if err != nil && !os.IsNotExist(err) {
@@ -368,7 +820,9 @@ func writeCreds(cfg config, keys map[string]string) error {
 	}
 
 	w("head")
-	err = tmpl.Execute(cf, keys)
+	if keys != nil {
+		err = tmpl.Execute(cf, keys)
+	}
 	w("tail")
 	if err != nil {
 		return fmt.Errorf("cant write creds file (exec template): %w", err)
@@ -394,13 +848,13 @@ func (p *profile) getCache() error {
 }
 
 func (p *profile) create(cfg config) error {
-	if p.token == "" {
+	if p.token.Value == "" {
 		return errors.New("invalid token")
 	}
 
 	retrycfg, err := awscfg.LoadDefaultConfig(
 		context.TODO(),
-		awscfg.WithRegion(p.region),
+		awscfg.WithRegion(p.cfg.Region),
 		awscfg.WithRetryer(func() aws.Retryer {
 			retryer := retry.AddWithMaxAttempts(retry.NewStandard(), 10)
 			return retry.AddWithMaxBackoffDelay(retryer, 30*time.Second)
@@ -414,7 +868,7 @@ func (p *profile) create(cfg config) error {
 	cli := sso.NewFromConfig(retrycfg)
 	pg := sso.NewListAccountsPaginator(
 		cli,
-		&sso.ListAccountsInput{AccessToken: aws.String(p.token)},
+		&sso.ListAccountsInput{AccessToken: aws.String(p.token.Value)},
 	)
 
 	accts := make(chan account)
@@ -441,7 +895,7 @@ func (p *profile) create(cfg config) error {
 				pg := sso.NewListAccountRolesPaginator(
 					cli,
 					&sso.ListAccountRolesInput{
-						AccessToken: aws.String(p.token),
+						AccessToken: aws.String(p.token.Value),
 						AccountId:   a.AccountId,
 					},
 				)
@@ -471,36 +925,33 @@ func (p *profile) create(cfg config) error {
 	}()
 
 	for a := range accts {
-		a.Slug = slugify(a.Name, cfg.StripPrefix, cfg.StripSuffix)
 		p.Accounts = append(p.Accounts, a)
 	}
 
-	_ = os.Remove(p.path)
 	b, err := json.Marshal(p)
 	if err != nil {
 		return fmt.Errorf("cant marshal profiles: %w", err)
 	}
-	if err := os.WriteFile(p.path, b, 0600); err != nil {
+	if err := writeCache(p.path, b); err != nil {
 		return fmt.Errorf("cant write profile cache %s: %w", p.path, err)
 	}
 
 	return nil
 }
 
-func (p profile) getKeys(choice string) (map[string]string, error) {
+func (b badge) getKeys(choice string) (map[string]string, error) {
 	keys := map[string]string{}
-	badge, ok := p.badges[choice]
-	if !ok {
+	if b.p == nil {
 		return keys, fmt.Errorf("'%s' does not match any profile", choice)
 	}
 
-	ssoc := sso.New(sso.Options{Region: p.region})
+	ssoc := sso.New(sso.Options{Region: b.p.cfg.Region})
 	o, err := ssoc.GetRoleCredentials(
 		context.Background(),
 		&sso.GetRoleCredentialsInput{
-			AccessToken: aws.String(p.token),
-			AccountId:   aws.String(badge.id),
-			RoleName:    aws.String(badge.role),
+			AccessToken: aws.String(b.p.token.Value),
+			AccountId:   aws.String(b.id),
+			RoleName:    aws.String(b.role),
 		},
 	)
 	if err != nil {
@@ -525,12 +976,25 @@ func (t *token) getCache() error {
 		return nil
 	}
 
-	if err := json.Unmarshal(b, &t); err != nil {
-		return fmt.Errorf("cant unmarshal token cache file %s: %w", t.path, err)
+	if t.cli {
+		if err := t.fromCLI(b); err != nil {
+			return fmt.Errorf("cant unmarshal aws cli token cache file %s: %w", t.path, err)
+		}
+	} else {
+		if err := json.Unmarshal(b, &t); err != nil {
+			return fmt.Errorf("cant unmarshal token cache file %s: %w", t.path, err)
+		}
+		if t.ExpiresAt.IsZero() && t.ExpiresIn > 0 { // old cache, best guess from mtime
+			t.IssuedAt = fi.ModTime()
+			t.ExpiresAt = fi.ModTime().Add(time.Duration(t.ExpiresIn) * time.Second)
+			t.ExpiresIn = 0
+			if err := t.write(); err != nil {
+				return fmt.Errorf("cant migrate token cache file %s: %w", t.path, err)
+			}
+		}
 	}
 
-	etime := fi.ModTime().Add(time.Duration(t.ExpiresIn) * time.Second)
-	if time.Now().Local().After(etime) {
+	if time.Now().Add(t.margin).After(t.ExpiresAt) {
 		t.Value = ""
 	}
 
@@ -538,69 +1002,304 @@ func (t *token) getCache() error {
 }
 
 func (t *token) create(cfg config) error {
-	opts := func(o *ssooidc.Options) { o.Region = cfg.Region }
-	oidc := ssooidc.New(ssooidc.Options{})
-	o, err := oidc.RegisterClient(
-		context.Background(),
-		&ssooidc.RegisterClientInput{
-			ClientName: aws.String("lash"),
-			ClientType: aws.String("public"),
-		},
-		opts,
-	)
-	if err != nil {
-		return fmt.Errorf("cant register for oidc: %w", err)
+	oidc := cfg.oidc()
+	if err := t.client.getCache(); err != nil {
+		return err
 	}
 
-	auth, err := oidc.StartDeviceAuthorization(
-		context.Background(),
-		&ssooidc.StartDeviceAuthorizationInput{
-			ClientId:     o.ClientId,
-			ClientSecret: o.ClientSecret,
-			StartUrl:     aws.String(cfg.StartURL),
-		},
-		opts,
-	)
+	flow := cfg.loginFlow()
+	if t.client.expired() || t.client.flow() != flow {
+		if err := t.client.register(oidc, flow, cfg.StartURL); err != nil {
+			return err
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var tok *ssooidc.CreateTokenOutput
+	var err error
+	for attempt := 0; ; attempt++ {
+		switch flow {
+		case flowDevice:
+			tok, err = t.device(ctx, cfg, oidc)
+		default:
+			tok, err = t.authCode(ctx, cfg, oidc)
+		}
+		if flow != flowCode || attempt > 0 || !clientRejected(err) {
+			break
+		}
+		fmt.Fprintln(os.Stderr, "sso rejected the client registration, registering again")
+		if err := t.client.register(oidc, flow, cfg.StartURL); err != nil {
+			return err
+		}
+	}
+	if clientRejected(err) || errors.Is(err, errLoginTimeout) { // make sure the next attempt registers again
+		_ = os.Remove(t.client.path)
+	}
 	if err != nil {
-		return fmt.Errorf("cant start device auth: %w", err)
+		return err
+	}
+
+	t.set(tok)
+	return t.write()
+}
+
+// device logs in with the device authorization grant, polling until the user
+// approves the code in the browser
+func (t *token) device(ctx context.Context, cfg config, oidc *ssooidc.Client) (*ssooidc.CreateTokenOutput, error) {
+	var auth *ssooidc.StartDeviceAuthorizationOutput
+	for attempt := 0; ; attempt++ {
+		var err error
+		auth, err = oidc.StartDeviceAuthorization(
+			ctx,
+			&ssooidc.StartDeviceAuthorizationInput{
+				ClientId:     aws.String(t.client.ID),
+				ClientSecret: aws.String(t.client.Secret),
+				StartUrl:     aws.String(cfg.StartURL),
+			},
+		)
+		if err == nil {
+			break
+		}
+		if attempt == 0 && clientRejected(err) { // stale registration, get a new one
+			if err := t.client.register(oidc, flowDevice, cfg.StartURL); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		return nil, fmt.Errorf("cant start device auth: %w", err)
+	}
+
+	if cfg.headless {
+		showCode(auth, cfg.qr)
+	} else {
+		browse(cfg.Browser, *auth.VerificationUriComplete)
 	}
+	fmt.Fprintln(os.Stderr, "waiting for the login to be approved in the browser (ctrl-c to give up)")
 
-	_ = browser.OpenURL(*auth.VerificationUriComplete)
-	fmt.Println("press enter when it's cooked")
-	_, err = fmt.Scanln()
+	tok, err := pollToken(ctx, oidc, t.client, auth)
 	if err != nil {
-		return fmt.Errorf("cant scan stdin: %w", err)
+		return nil, fmt.Errorf("cant create token: %w", err)
+	}
+	return tok, nil
+}
+
+// refresh redeems the cached refresh token for a new access token without a
+// browser pop. if the refresh token or client registration has expired or been
+// revoked, t.Value is left empty so the caller falls back to create
+func (t *token) refresh(cfg config) error {
+	if t.client.ID == "" { // the aws cli cache carries its own registration
+		if err := t.client.getCache(); err != nil {
+			return err
+		}
+	}
+	if t.client.expired() {
+		return nil
 	}
 
+	oidc := cfg.oidc()
 	tok, err := oidc.CreateToken(
 		context.Background(),
 		&ssooidc.CreateTokenInput{
-			ClientId:     o.ClientId,
-			ClientSecret: o.ClientSecret,
-			DeviceCode:   auth.DeviceCode,
-			GrantType:    aws.String("urn:ietf:params:oauth:grant-type:device_code"),
+			ClientId:     aws.String(t.client.ID),
+			ClientSecret: aws.String(t.client.Secret),
+			GrantType:    aws.String(grantRefresh),
+			RefreshToken: aws.String(t.RefreshToken),
 		},
-		opts,
 	)
-	if err != nil {
-		return fmt.Errorf("cant create token: %w", err)
+	var grant *otyp.InvalidGrantException
+	var expired *otyp.ExpiredTokenException
+	switch {
+	case errors.As(err, &grant), errors.As(err, &expired), clientRejected(err):
+		t.RefreshToken = ""
+		return nil
+	case err != nil:
+		return fmt.Errorf("cant refresh token: %w", err)
 	}
 
+	t.set(tok)
+	return t.write()
+}
+
+func (t *token) set(tok *ssooidc.CreateTokenOutput) {
 	t.Value = *tok.AccessToken
-	t.ExpiresIn = int(tok.ExpiresIn)
+	t.IssuedAt = time.Now().UTC()
+	t.ExpiresAt = t.IssuedAt.Add(time.Duration(tok.ExpiresIn) * time.Second)
+	if tok.RefreshToken != nil { // a refresh may or may not rotate it
+		t.RefreshToken = *tok.RefreshToken
+	}
+}
 
-	_ = os.Remove(t.path)
-	b, err := json.Marshal(t)
+func (t token) write() error {
+	var b []byte
+	var err error
+	if t.cli {
+		b, err = t.toCLI()
+	} else {
+		b, err = json.Marshal(t)
+	}
 	if err != nil {
 		return fmt.Errorf("cant marshal new token: %w", err)
 	}
-	if err := os.WriteFile(t.path, b, 0600); err != nil {
+	if err := writeCache(t.path, b); err != nil {
 		return fmt.Errorf("cant write token cache %s: %w", t.path, err)
 	}
+	return nil
+}
+
+func (c *client) getCache() error {
+	fi, b, err := getFile(filepath.Clean(c.path))
+	if err != nil {
+		return fmt.Errorf("cant get client cache file %s: %w", c.path, err)
+	}
+	if fi == nil || b == nil {
+		return nil
+	}
+
+	if err := json.Unmarshal(b, &c); err != nil {
+		return fmt.Errorf("cant unmarshal client cache file %s: %w", c.path, err)
+	}
+	return nil
+}
+
+// expired is true when there's no usable registration. the registration is
+// treated as expired an hour early so it doesn't lapse mid-login
+func (c client) expired() bool {
+	return c.ID == "" || time.Now().Add(time.Hour).Unix() >= c.ExpiresAt
+}
+
+// flow is the login flow the client was registered for, registrations cached
+// before the code flow existed are all device registrations
+func (c client) flow() string {
+	if c.Flow == "" {
+		return flowDevice
+	}
+	return c.Flow
+}
+
+// register gets a new oidc client registration for the login flow and caches
+// it until ClientSecretExpiresAt
+func (c *client) register(oidc *ssooidc.Client, flow, starturl string) error {
+	in := &ssooidc.RegisterClientInput{
+		ClientName: aws.String("lash"),
+		ClientType: aws.String("public"),
+		GrantTypes: []string{grantDevice, grantRefresh},
+		Scopes:     []string{ssoScope},
+	}
+	if flow == flowCode {
+		in.GrantTypes = []string{grantCode, grantRefresh}
+		in.RedirectUris = []string{redirectURI}
+		in.IssuerUrl = aws.String(starturl)
+	}
+
+	o, err := oidc.RegisterClient(context.Background(), in)
+	if err != nil {
+		return fmt.Errorf("cant register for oidc: %w", err)
+	}
+	c.ID = *o.ClientId
+	c.Secret = *o.ClientSecret
+	c.ExpiresAt = o.ClientSecretExpiresAt
+	c.Flow = flow
+	return c.write()
+}
+
+// clientRejected is true when the oidc service no longer accepts the client
+// registration - it has expired early or been deleted
+func clientRejected(err error) bool {
+	var inval *otyp.InvalidClientException
+	var unauth *otyp.UnauthorizedClientException
+	var aerr authError
+	if errors.As(err, &aerr) { // the browser came back from authorize with an error
+		return aerr.code == "invalid_client" || aerr.code == "unauthorized_client"
+	}
+	return errors.As(err, &inval) || errors.As(err, &unauth)
+}
+
+func (c client) write() error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("cant marshal client registration: %w", err)
+	}
+	if err := writeCache(c.path, b); err != nil {
+		return fmt.Errorf("cant write client cache %s: %w", c.path, err)
+	}
+	return nil
+}
 
+// relogin throws away a token sso has rejected (revoked, or the portal session
+// ended early) and logs in again. the profile cache is left alone
+func (t *token) relogin(cfg config) error {
+	_ = os.Remove(t.path)
+	t.Value = ""
+	t.RefreshToken = ""
+	if err := t.create(cfg); err != nil {
+		return fmt.Errorf("cant log in again: %w", err)
+	}
 	return nil
 }
 
+// unauthorized is true when sso has rejected the access token
+func unauthorized(err error) bool {
+	var unauth *typ.UnauthorizedException
+	return errors.As(err, &unauth)
+}
+
+// pollToken calls CreateToken on the interval given by StartDeviceAuthorization
+// until the device code is approved, denied, expires or ctx is cancelled
+func pollToken(ctx context.Context, oidc *ssooidc.Client, c client, auth *ssooidc.StartDeviceAuthorizationOutput) (*ssooidc.CreateTokenOutput, error) {
+	interval := time.Duration(auth.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second // the rfc 8628 default
+	}
+	deadline := time.Now().Add(time.Duration(auth.ExpiresIn) * time.Second)
+
+	for {
+		tok, err := oidc.CreateToken(
+			ctx,
+			&ssooidc.CreateTokenInput{
+				ClientId:     aws.String(c.ID),
+				ClientSecret: aws.String(c.Secret),
+				DeviceCode:   auth.DeviceCode,
+				GrantType:    aws.String(grantDevice),
+			},
+		)
+		if err == nil {
+			return tok, nil
+		}
+
+		var pending *otyp.AuthorizationPendingException
+		var slow *otyp.SlowDownException
+		switch {
+		case ctx.Err() != nil:
+			return nil, errors.New("login cancelled")
+		case errors.As(err, &slow):
+			interval += 5 * time.Second
+		case errors.As(err, &pending):
+		default:
+			return nil, err
+		}
+
+		if time.Now().Add(interval).After(deadline) {
+			return nil, errors.New("device code expired before the login was approved")
+		}
+		select {
+		case <-ctx.Done():
+			return nil, errors.New("login cancelled")
+		case <-time.After(interval):
+		}
+	}
+}
+
+// writeCache replaces the cache file at path, making its directory if needed
+func writeCache(path string, b []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	_ = os.Remove(path)
+	return os.WriteFile(path, b, 0600)
+}
+
 func getFile(path string) (os.FileInfo, []byte, error) {
 	fi, err := os.Stat(path)
 	if err != nil {
@@ -622,26 +1321,278 @@ func getFile(path string) (os.FileInfo, []byte, error) {
 	return fi, b, nil
 }
 
-func loadConfig(basedir string) (config, error) {
-	cf := filepath.Join(basedir, "lash", "config.json")
-	b, err := os.ReadFile(filepath.Clean(cf))
+func loadConfig(basedir string, flags map[string]string) (config, error) {
+	c := config{
+		basedir:  basedir,
+		cachedir: filepath.Join(basedir, "lash"),
+		name:     defaultInstance,
+	}
+	l, err := loadLayers(filepath.Join(basedir, "lash"))
+	if err != nil {
+		return config{}, err
+	}
+	b, err := json.Marshal(l.merged)
 	if err != nil {
-		return config{}, fmt.Errorf("cant open config: %w\ndo you need to run `lash -init` to create your config file?", err)
+		return config{}, fmt.Errorf("cant marshal config: %w", err)
 	}
-	c := config{basedir: basedir}
 	if err := json.Unmarshal(b, &c); err != nil {
 		return config{}, fmt.Errorf("cant unmarshal config: %w", err)
 	}
-	if c.Region == "" {
-		return config{}, errors.New("config error: missing region")
+	if c.StartURL == "" && len(c.Instances) < 1 { // maybe aws cli or the environ knows the sso details
+		ss, _ := ssoSessions(awsConfigPath(basedir))
+		c.useSessions(ss)
+	}
+	c.fromEnv()
+	for k, v := range flags {
+		*c.field(k) = v
 	}
-	if c.StartURL == "" {
+	if c.StartURL == "" && len(c.Instances) < 1 {
+		if len(l.files) < 1 {
+			return config{}, errors.New("cant open config: no config file\ndo you need to run `lash -init` to create your config file?")
+		}
 		return config{}, errors.New("config error: missing start_url")
 	}
+	if c.StartURL != "" && c.Region == "" {
+		return config{}, errors.New("config error: missing region")
+	}
+	if err := c.check(); err != nil {
+		return config{}, err
+	}
 	return c, nil
 }
 
-func setup(basedir string) error {
+// check checks and compiles the config: the instances, the rewrites and
+// filter, the role preferences and the plain keys that arent free text. it
+// sets the expiry margin
+func (c *config) check() error {
+	names := map[string]bool{defaultInstance: true}
+	for i, in := range c.Instances {
+		switch {
+		case !instanceName.MatchString(in.Name):
+			return fmt.Errorf("config error: instance %d needs a name of lowercase letters, digits and dashes", i+1)
+		case names[in.Name]:
+			return fmt.Errorf("config error: instance name %q is used more than once (or is %q)", in.Name, defaultInstance)
+		case in.Region == "":
+			return fmt.Errorf("config error: instance %q is missing region", in.Name)
+		case in.StartURL == "":
+			return fmt.Errorf("config error: instance %q is missing start_url", in.Name)
+		}
+		names[in.Name] = true
+		if err := in.AccountRewrite.compile("instance " + in.Name + " account_rewrite"); err != nil {
+			return err
+		}
+		if err := in.RoleRewrite.compile("instance " + in.Name + " role_rewrite"); err != nil {
+			return err
+		}
+	}
+	if err := c.AccountRewrite.compile("account_rewrite"); err != nil {
+		return err
+	}
+	if err := c.RoleRewrite.compile("role_rewrite"); err != nil {
+		return err
+	}
+	if c.Filter != nil {
+		if err := c.Filter.compile(); err != nil {
+			return err
+		}
+	}
+	for _, pref := range c.RolePreference {
+		if _, err := path.Match(pref, ""); err != nil {
+			return fmt.Errorf("config error: role_preference %q: %w", pref, err)
+		}
+	}
+	if c.Login != "" && c.Login != flowCode && c.Login != flowDevice {
+		return fmt.Errorf("config error: login must be %q or %q", flowCode, flowDevice)
+	}
+	c.margin = 5 * time.Minute
+	if c.ExpiryMargin != "" {
+		var err error
+		c.margin, err = time.ParseDuration(c.ExpiryMargin)
+		if err != nil || c.margin < 0 {
+			return fmt.Errorf("config error: expiry_margin %q is not a duration like \"5m\"", c.ExpiryMargin)
+		}
+	}
+	return nil
+}
+
+// fromEnv overrides config keys with LASH_ environment variables
+func (c *config) fromEnv() {
+	for _, k := range settable {
+		if v := os.Getenv(envName(k)); v != "" {
+			*c.field(k) = v
+		}
+	}
+	if v, err := strconv.ParseBool(os.Getenv("LASH_CLI_CACHE")); err == nil {
+		c.CLICache = v
+	}
+}
+
+// credsPath is the credentials file lash manages, AWS_SHARED_CREDENTIALS_FILE
+// or credentials in the basedir
+func (c config) credsPath() string {
+	if p := os.Getenv("AWS_SHARED_CREDENTIALS_FILE"); p != "" {
+		return p
+	}
+	return filepath.Join(c.basedir, "credentials")
+}
+
+// instances are the configs for each sso instance: the top-level one (if it
+// has a start url) and then each of the extra instances
+func (c config) instances() []config {
+	cfgs := []config{}
+	if c.StartURL != "" {
+		cfgs = append(cfgs, c)
+	}
+	for _, in := range c.Instances {
+		ic := c
+		ic.name = in.Name
+		ic.prefix = in.Prefix
+		ic.cachedir = filepath.Join(c.cachedir, in.Name)
+		ic.Region = in.Region
+		ic.StartURL = in.StartURL
+		ic.SSOSession = in.SSOSession
+		if in.RoleStripPrefix != "" {
+			ic.RoleStripPrefix = in.RoleStripPrefix
+		}
+		if in.RoleStripSuffix != "" {
+			ic.RoleStripSuffix = in.RoleStripSuffix
+		}
+		if in.StripPrefix != "" {
+			ic.StripPrefix = in.StripPrefix
+		}
+		if in.StripSuffix != "" {
+			ic.StripSuffix = in.StripSuffix
+		}
+		if len(in.AccountRewrite) > 0 {
+			ic.AccountRewrite = in.AccountRewrite
+		}
+		if len(in.RoleRewrite) > 0 {
+			ic.RoleRewrite = in.RoleRewrite
+		}
+		cfgs = append(cfgs, ic)
+	}
+	return cfgs
+}
+
+// label names the sso instance in messages, the top-level one goes unnamed
+func (c config) label() string {
+	if c.name == defaultInstance {
+		return ""
+	}
+	return " (" + c.name + ")"
+}
+
+// caches are all the files lash caches secrets and sso data in
+func (c config) caches() []string {
+	paths := []string{
+		filepath.Join(c.cachedir, "oidc.json"),
+		filepath.Join(c.cachedir, "client.json"),
+		filepath.Join(c.cachedir, "profile.json"),
+	}
+	if c.CLICache {
+		paths = append(paths, c.cliCachePath())
+	}
+	return paths
+}
+
+// settingsFor is the profile settings for slug, badge b. the settings for every
+// glob matching it are merged in order, then the settings keyed by the slug
+// itself: later ones win, env is merged by variable and tags are added
+// together. a glob matches the slug or, for one qualified with an instance
+// name or account id, the slug before that (as * doesnt match /), so
+// "*-prod-*" still covers client/data-prod-admin
+func (c config) settingsFor(slug string, b badge) profileSettings {
+	keys := []string{}
+	for k := range c.Profiles {
+		if k == slug {
+			continue
+		}
+		ok, _ := path.Match(k, slug)
+		if !ok && b.base != "" {
+			ok, _ = path.Match(k, b.base)
+		}
+		if ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	if _, ok := c.Profiles[slug]; ok {
+		keys = append(keys, slug)
+	}
+
+	ps := profileSettings{Browser: c.Browser, Env: map[string]string{}}
+	for _, k := range keys {
+		s := c.Profiles[k]
+		if s.Browser != "" {
+			ps.Browser = s.Browser
+		}
+		if s.Region != "" {
+			ps.Region = s.Region
+		}
+		if s.Destination != "" {
+			ps.Destination = s.Destination
+		}
+		for ek, ev := range s.Env {
+			ps.Env[ek] = ev
+		}
+		for _, t := range s.Tags {
+			if !in(ps.Tags, t) {
+				ps.Tags = append(ps.Tags, t)
+			}
+		}
+	}
+	return ps
+}
+
+// destination is the console url to land on: the configured destination (a
+// path is on the console), else the console home in the profile's region
+func (ps profileSettings) destination() string {
+	switch {
+	case strings.HasPrefix(ps.Destination, "/"):
+		return "https://console.aws.amazon.com" + ps.Destination
+	case ps.Destination != "":
+		return ps.Destination
+	case ps.Region != "":
+		return "https://" + ps.Region + ".console.aws.amazon.com/console/home?region=" + url.QueryEscape(ps.Region)
+	}
+	return "https://console.aws.amazon.com/"
+}
+
+// loginFlow is the configured login flow, the code flow unless told otherwise.
+// headless logins are always device logins, the code flow needs a local browser
+func (c config) loginFlow() string {
+	if c.Login == flowDevice || c.headless {
+		return flowDevice
+	}
+	return flowCode
+}
+
+// oidc is an sso oidc client for the configured region, or for oidc_endpoint
+// when it's set (e.g. to point lash at a local stand-in oidc server)
+func (c config) oidc() *ssooidc.Client {
+	o := ssooidc.Options{Region: c.Region}
+	if c.OIDCEndpoint != "" {
+		o.BaseEndpoint = aws.String(c.OIDCEndpoint)
+	}
+	return ssooidc.New(o)
+}
+
+// authorizeURL is the oidc authorize endpoint which sits alongside the api
+func (c config) authorizeURL() string {
+	if c.OIDCEndpoint != "" {
+		return strings.TrimSuffix(c.OIDCEndpoint, "/") + "/authorize"
+	}
+	return "https://oidc." + c.Region + ".amazonaws.com/authorize"
+}
+
+// setup makes the lash subdirectory and creates or updates the config file with
+// vals (config keys to values), in format if it's set. the region and start url
+// are prompted for when they're still missing, if there's a terminal to prompt
+// on. only the user's config is written, so they're not missing if the system
+// config or an included file has them. the file is only written when something
+// changes, and a yaml or toml file with comments isnt rewritten (losing them)
+// unless format is set
+func setup(basedir string, vals map[string]string, format string) error {
 	base := filepath.Clean(basedir)
 	if _, err := os.Stat(base); os.IsNotExist(err) {
 		return fmt.Errorf("basedir '%s' does not exist", base)
@@ -654,38 +1605,184 @@ func setup(basedir string) error {
 		}
 	}
 
-	region, starturl := "", ""
+	cfg := config{basedir: basedir}
+	lashcfg, _ := findConfig(lash)
+	b, err := os.ReadFile(filepath.Clean(lashcfg))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cant read config %s: %w", lashcfg, err)
+	}
+	exists, commented := err == nil, err == nil && hasComments(lashcfg, b)
+	if exists {
+		m, err := decodeConfig(lashcfg, b)
+		if err != nil {
+			return err
+		}
+		b, _ = json.Marshal(m)
+		if err := json.Unmarshal(b, &cfg); err != nil {
+			return fmt.Errorf("cant unmarshal config %s: %w", lashcfg, err)
+		}
+	}
+
+	// the config lash will run with, from the system config and includes too
+	l, err := loadLayers(lash)
+	if err != nil {
+		return err
+	}
+	merged := config{}
+	b, _ = json.Marshal(l.merged)
+	if err := json.Unmarshal(b, &merged); err != nil {
+		return fmt.Errorf("cant unmarshal config: %w", err)
+	}
+	hasRegion := func() bool { return cfg.Region != "" || merged.Region != "" }
+	hasStartURL := func() bool { return cfg.StartURL != "" || merged.StartURL != "" }
+
+	newcfg := lashcfg
+	if format != "" {
+		ext, err := formatExt(format)
+		if err != nil {
+			return err
+		}
+		newcfg = filepath.Join(lash, "config"+ext)
+	}
+	write := func() error {
+		if commented && format == "" {
+			return fmt.Errorf("not rewriting %s, it has comments that would be lost. edit it instead, or give -format to rewrite it anyway", lashcfg)
+		}
+		eff := merged // what the next run will load, so dont write what it'd reject
+		for _, k := range settable {
+			if v := *cfg.field(k); v != "" {
+				*eff.field(k) = v
+			}
+		}
+		if err := eff.check(); err != nil {
+			return err
+		}
+		if err := writeConfig(newcfg, cfg); err != nil {
+			return err
+		}
+		if newcfg != lashcfg { // switching formats, dont leave the old one to win
+			if err := os.Remove(lashcfg); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("cant remove old config %s: %w", lashcfg, err)
+			}
+		}
+		return nil
+	}
+	changed := !exists || format != ""
+	for k, v := range vals {
+		changed = changed || *cfg.field(k) != v
+		*cfg.field(k) = v
+	}
+	if (hasRegion() && hasStartURL()) || len(cfg.Instances) > 0 || len(merged.Instances) > 0 {
+		if !changed {
+			return nil
+		}
+		return write()
+	}
+	if !interactive() {
+		return errors.New("missing region or start url, set them with -region and -start-url (or LASH_INIT_REGION and LASH_INIT_START_URL)")
+	}
+
 	r := bufio.NewReader(os.Stdin)
+	acf := awsConfigPath(basedir)
+	ss, err := ssoSessions(acf)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "not importing from aws config: %v\n", err)
+	}
+	if len(ss) > 0 && !hasRegion() && !hasStartURL() {
+		fmt.Printf("found sso sessions in %s\n", acf)
+		for _, s := range ss {
+			fmt.Printf("  %s  %s  %s\n", s.name, s.region, s.starturl)
+		}
+		fmt.Print("use them? [Y/n] ~> ")
+		yn, _ := r.ReadString('\n')
+		if yn = strings.ToLower(strings.TrimSpace(yn)); yn == "" || yn == "y" || yn == "yes" {
+			cfg.useSessions(ss)
+			return write()
+		}
+	}
+
 	fmt.Println("tell me some things for config")
 	fmt.Println("~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~")
-	for {
+	for !hasRegion() {
 		fmt.Print("   region ~> ")
-		region, _ = r.ReadString('\n')
-		region = strings.Replace(region, "\n", "", -1)
-		if region != "" {
-			break
+		if cfg.Region, err = r.ReadString('\n'); err != nil {
+			return fmt.Errorf("cant read region: %w", err)
 		}
+		cfg.Region = strings.TrimSpace(cfg.Region)
 	}
-	for {
+	for !hasStartURL() {
 		fmt.Print("start url ~> ")
-		starturl, _ = r.ReadString('\n')
-		starturl = strings.Replace(starturl, "\n", "", -1)
-		if starturl != "" {
-			break
+		if cfg.StartURL, err = r.ReadString('\n'); err != nil {
+			return fmt.Errorf("cant read start url: %w", err)
 		}
+		cfg.StartURL = strings.TrimSpace(cfg.StartURL)
 	}
 
-	cfg := config{
-		basedir:  basedir,
-		Region:   region,
-		StartURL: starturl,
+	return write()
+}
+
+// interactive is true when stdin is a terminal to prompt on
+func interactive() bool {
+	return term.IsTerminal(int(os.Stdin.Fd()))
+}
+
+// settable are the plain string config keys. -init can set them with flags
+// named for the key (dashes for underscores) or LASH_INIT_ environment
+// variables, and LASH_ environment variables override them at runtime
+var settable = []string{
+	"region",
+	"start_url",
+	"sso_session",
+	"login",
+	"browser",
+	"expiry_margin",
+	"strip_prefix",
+	"strip_suffix",
+	"role_strip_prefix",
+	"role_strip_suffix",
+}
+
+// field is the config field for a key in settable
+func (c *config) field(key string) *string {
+	switch key {
+	case "region":
+		return &c.Region
+	case "start_url":
+		return &c.StartURL
+	case "sso_session":
+		return &c.SSOSession
+	case "login":
+		return &c.Login
+	case "browser":
+		return &c.Browser
+	case "expiry_margin":
+		return &c.ExpiryMargin
+	case "strip_prefix":
+		return &c.StripPrefix
+	case "strip_suffix":
+		return &c.StripSuffix
+	case "role_strip_prefix":
+		return &c.RoleStripPrefix
+	case "role_strip_suffix":
+		return &c.RoleStripSuffix
 	}
-	b, err := json.MarshalIndent(cfg, "", "  ")
+	return nil
+}
+
+func flagName(key string) string { return strings.ReplaceAll(key, "_", "-") }
+func envName(key string) string  { return "LASH_" + strings.ToUpper(key) }
+
+// initEnvName is the environment variable -init takes a key from. it's not the
+// runtime override, so a direnv LASH_REGION doesnt end up in the config
+func initEnvName(key string) string { return "LASH_INIT_" + strings.ToUpper(key) }
+
+func writeConfig(lashcfg string, cfg config) error {
+	b, err := encodeConfig(lashcfg, cfg)
 	if err != nil {
 		return fmt.Errorf("cant marshal new config: %w", err)
 	}
 
-	lashcfg := filepath.Clean(filepath.Join(lash, "config.json"))
+	lashcfg = filepath.Clean(lashcfg)
 	if err := os.WriteFile(lashcfg, b, 0600); err != nil {
 		return fmt.Errorf("cant write config %s: %w", lashcfg, err)
 	}
@@ -700,6 +1797,36 @@ func slugify(s, sp, ss string) string {
 	return s
 }
 
+// flagSet is whether the flag was given on the command line
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// envBool is true when the environment variable is set to true, 1, etc
+func envBool(name string) bool {
+	v, _ := strconv.ParseBool(os.Getenv(name))
+	return v
+}
+
+// headless guesses whether there's a browser to pop: not over ssh, and not on
+// a linux (or bsd) box without a display server
+func headless() bool {
+	if os.Getenv("SSH_CONNECTION") != "" || os.Getenv("SSH_TTY") != "" {
+		return true
+	}
+	switch runtime.GOOS {
+	case "darwin", "windows":
+		return false
+	}
+	return os.Getenv("DISPLAY") == "" && os.Getenv("WAYLAND_DISPLAY") == ""
+}
+
 func in(ss []string, s string) bool {
 	for _, v := range ss {
 		if s == v {
@@ -709,13 +1836,17 @@ func in(ss []string, s string) bool {
 	return false
 }
 
+var instanceName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
 var cReset = "\033[0m"
 var cGreen = "\033[32m"
+var cQR = "\033[97;40m"
 
 func init() {
 	if runtime.GOOS == "windows" {
 		cReset = ""
 		cGreen = ""
+		cQR = ""
 	}
 }
 
@@ -725,7 +1856,8 @@ aws_access_key_id={{ .AccessKeyId }}
 aws_secret_access_key={{ .SecretAccessKey }}
 aws_session_token={{ .SessionToken }}
 aws_security_token={{ .SessionToken }}
-`
+{{ with .Region }}region={{ . }}
+{{ end }}`
 
 const usageTop = `──╖  ╭─┐╭──┐ ╥──┤ less annoying sso helper
   ║  ┼─┤┴─┐┼─╫  └───╴╶─╶───────╶─────────╱╴╴╴
@@ -740,16 +1872,52 @@ SUMMARY
   use it either as an account picker, a command shim, or to get a console url
 
 FLAGS
+  -a  show all profiles, including the ones hidden by the config filter
   -d  the directory with the creds and lash/ subdirectory (basedir)
   -h  print this help
+  -config  print the effective config, merged from the system config, any
+           includes and lash/config.json, with the file each value came from
   -n  dont use the nickname map from config
   -r  refresh the oidc token and the profiles (full refresh)
+  -s  show how long the sso session has left
+  -o  open an aws console url for the chosen role in the browser
   -u  generate an aws console url for the chosen role
   -v  print the program version
 
-  -init  initializes the lash config.json file (and lash/ subdirectory) by
-         prompting for region and start url values. nullifies any other
-         configuration settings (nicks, prefixes, etc).
+  -init  initializes the lash config.json file (and lash/ subdirectory), or
+         updates it. config keys can be set with flags named for the key, e.g.,
+         -region, -start-url, -strip-prefix, or with LASH_INIT_ environment
+         variables, e.g., LASH_INIT_REGION, LASH_INIT_START_URL (the plain
+         LASH_ overrides are never written). only the keys given are
+         changed, the rest of an existing config (nicks etc) is kept. if the
+         region or start url is still missing (from the system config and
+         includes too) lash offers to import the sso sessions from the aws
+         config, or else prompts for them. the keys are:
+         region, start_url, sso_session, login, browser, expiry_margin,
+         strip_prefix, strip_suffix, role_strip_prefix, role_strip_suffix.
+         values are checked before anything is written. without a terminal,
+         lash exits once the config is written
+  -format  with -init, write the config as json (the default), yaml or toml.
+           an existing config in another format is replaced. without -format,
+           -init wont rewrite a yaml or toml config that has comments, as
+           they'd be lost; with it, they're lost
+  -region, -start-url, -login, etc  the flags for the config keys -init sets
+           also override the config (and LASH_<KEY>) for one run without -init
+
+  -logout  end the sso session and delete the lash caches (token, client
+           registration and profiles)
+  -purge   like -logout, and also remove the profile history and the managed
+           [default] profile from the credentials file, keeping
+           credentials-head and -tail
+
+  -recent  list the recently used profiles. with a profile, dont pick one of
+           several matches just because it's the most used
+
+  -headless  dont try to open a browser to log in, print the login url and
+             code instead and wait for the login to be approved elsewhere.
+             this is automatic over ssh or when there's no display, unless
+             -headless=false or LASH_HEADLESS=false says otherwise
+  -qr        like -headless, and also draw the login url as a qr code
 
 PROFILES
   lash refers to the combination of an account and permission set as a profile.
@@ -759,7 +1927,19 @@ PROFILES
   account is rendered as "data-dev-admin".
 
 ARGUMENTS
-  profile  [optional] a string which uniquely matches a profile
+  profile  [optional] a string which matches a profile: fully, or fuzzily
+           (letters in order, word starts after a - count for more and
+           longer strings can have a typo). the best match is used if it's
+           clearly better than the rest. failing that, if the best matches
+           are all in one account, the role first in role_preference, or
+           else the one used far more than the others lately (see -recent).
+           several terms split by spaces or commas must all match. a term
+           can be qualified to match just the account id (exactly), the
+           account or the role: id:123456789012, acct:data-dev,
+           role:readonly. without a profile, or without a clear match, lash
+           shows a picker on a terminal: type to filter, up/down (or
+           ctrl-p/ctrl-n) to move, enter to pick, esc to give up. without a
+           terminal it lists the profiles instead
   command  [optional] a command to run with creds in the environ
 
 BASE DIRECTORY
@@ -768,10 +1948,14 @@ BASE DIRECTORY
   below if this frightens you.
 
   use the -init flag to create the subdirectory and an initial config.json if
-  you like.
+  you like. when no config file sets a start url, lash uses the [sso-session]
+  blocks in the aws config file (config in the basedir, or AWS_CONFIG_FILE) if
+  it has any.
 
 CONFIG FILE
-  is JSON - soz
+  is lash/config.json, config.yaml (or .yml) or config.toml - yaml and toml
+  have comments. if there's more than one, json beats yaml beats toml and lash
+  says which it's ignoring. unknown keys are an error in any format.
   it's an object with the following top-level keys
 
   region             the aws region, e.g.,, ap-southeast-2
@@ -785,6 +1969,69 @@ CONFIG FILE
   strip_prefix       [optional] a string to strip from the beginning of profile
                      names. e.g., "company-slug-"
   strip_suffix       [optional] a string to strip from the end of profile names
+  account_rewrite    [optional] a list of regex rules, each an object with
+                     find and replace keys, run in order over account names
+                     before they're slugified and stripped. replace can use
+                     groups from find, e.g., "$1". e.g.,
+                     [{"find": "^(Acme|Initech) ", "replace": ""}]
+  role_rewrite       [optional] like account_rewrite, for role (permission
+                     set) names, before role_strip_prefix and -suffix. e.g.,
+                     [{"find": "^AWSReservedSSO_(.+)_[0-9a-f]+$",
+                       "replace": "$1"}]
+  login              [optional] how to log in to sso: "code" (the default)
+                     opens the browser and catches the redirect on 127.0.0.1,
+                     "device" uses a device code instead
+  oidc_endpoint      [optional] override the sso oidc endpoint, e.g., to test
+                     against a local stand-in oidc server
+  cli_cache          [optional] true to share the sso token with aws cli v2 by
+                     using its cache (sso/cache/ in the basedir) instead of
+                     lash/oidc.json. logging in with either tool covers both
+  sso_session        [optional] the name of the matching [sso-session] in the
+                     aws cli config, if there is one. the cli keys its cache
+                     on the session name, or on the start url without one
+  expiry_margin      [optional] treat the sso token as expired this early, as
+                     a go duration. defaults to "5m"
+  browser            [optional] the command to open urls with instead of the
+                     system default browser. {url} is replaced with the url,
+                     or it's added to the end. e.g.,
+                     "google-chrome --profile-directory=Work {url}"
+  filter             [optional] an object with include and exclude lists of
+                     patterns to hide profiles. a pattern is a glob, e.g.,
+                     "*sandbox*", or a regex between slashes, e.g., "/^dev-/"
+                     and is matched against the account name, account id and
+                     role name. with include, only profiles matching one of
+                     its patterns are shown. profiles matching an exclude
+                     pattern are hidden. -a shows them anyway
+  role_preference    [optional] a list of role names (or globs), most preferred
+                     first, e.g., ["readonly", "poweruser", "admin"]. when
+                     the best matches are all roles in one account, the most
+                     preferred of them is picked (and lash says which)
+  profiles           [optional] an object with keys for profile names, or
+                     globs like "*-prod-*", and values of per-profile settings:
+                       browser      the browser command for console urls (-o)
+                       region       the default region: region= in the creds
+                                    file, AWS_REGION and AWS_DEFAULT_REGION in
+                                    the command shim, and the console region
+                       env          an object of extra environment variables
+                                    for the command shim
+                       destination  the console page for -u and -o, a url or
+                                    a path like "/s3/home"
+                       tags         a list of tags shown beside the profile
+                                    in the listing
+                     settings for the globs matching a profile are merged in
+                     order, then its own: env is merged and tags are added up.
+                     a glob also matches a qualified name like client/x or
+                     111111111111/x by the x
+  instances          [optional] a list of extra sso instances (start urls),
+                     each an object with name, region and start_url keys, and
+                     optionally sso_session, prefix (prepended to its profile
+                     names) and the strip and rewrite keys above. each
+                     instance has its own caches in lash/<name>/ and its
+                     profiles are listed with the rest. region and start_url
+                     at the top level are optional when there are instances
+  include            [optional] a list of config files to merge in first, e.g.,
+                     a team config kept in a shared repo. relative paths are
+                     relative to the including file, ~/ is the home directory
 
   e.g.: {
     "region": "ap-southeast-2",
@@ -793,21 +2040,52 @@ CONFIG FILE
     "strip_prefix": "startup-"
   }
 
+LAYERED CONFIG
+  the config is merged from, in order:
+    the config file in /etc/lash (%ProgramData%\lash on windows), or
+      LASH_SYSTEM_CONFIG, and the files it includes
+    the files included by the config file in lash/
+    the config file in lash/
+  a file's includes come before the file itself and later files win: objects
+  like nicks and profiles are merged key by key, instances are merged by name
+  and any other value (strings, lists) is replaced. any of the files can be
+  missing except includes. -config shows where each value came from
+
 CUSTOM CREDENTIALS
   if you have named, pet creds you need to keep around, use either
   credentials-head or credentials-tail files in the same directory as
   credentials (the aws creds file). they will not be managed and will be
   added to the resulting creds file in a predictable manner.
 
+ENVIRONMENT
+  LASH_DIR         the basedir, like -d
+  LASH_NO_NICKS    true to disable nicks, like -n
+  LASH_HEADLESS    true to log in headless, like -headless, or false to never
+                   guess headless
+  LASH_CLI_CACHE   true or false, overrides cli_cache in the config
+  LASH_<KEY>       overrides a config key, e.g., LASH_REGION, LASH_START_URL,
+                   LASH_STRIP_PREFIX. the keys are the ones -init can set, and
+                   each has a flag (e.g., -region) that beats it
+  AWS_SHARED_CREDENTIALS_FILE  the credentials file to write instead of the
+                   one in the basedir (-head and -tail files sit next to it)
+  AWS_CONFIG_FILE  the aws config file to find sso sessions in
+  LASH_SYSTEM_CONFIG  the system-wide config file instead of the one in
+                   /etc/lash
+
+  flags beat environment variables, which beat the config file, which beats
+  the defaults. -init doesnt write LASH_<KEY> to the config, it takes
+  LASH_INIT_<KEY> (e.g., LASH_INIT_REGION) instead, like the flags.
+
 EXIT CODES
   1   initialization error - probably something is wrong with the os env
-  2   cant load config file (lash/config.json)
+  2   cant load config file (lash/config.json, .yaml or .toml)
   3   problem creating lash subdirectory or config file
   4   problem getting or writing the cache files (oidc token and profiles)
   5   problem getting the role credentials (keys - probably an auth thing)
   6   problem managing the credentials file (permissions or existence)
   9   problem with supplied command (command shim mode)
-  11  supplied profile slug has no matches or more than one match
+  11  supplied profile slug has no matches or more than one match, or no
+      profile was picked in the picker
   12  problem getting console signin url
   64  incorrect invocation (usage)
 `
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSettingsFor(t *testing.T) {
+	cfg := config{Profiles: map[string]profileSettings{
+		"*-prod-*":                {Region: "us-west-2", Tags: []string{"prod"}},
+		"client/*":                {Tags: []string{"client"}},
+		"client/data-prod-admin":  {Env: map[string]string{"TF_WORKSPACE": "data"}},
+		"111111111111/user-admin": {Tags: []string{"old"}},
+	}}
+	tests := []struct {
+		name string
+		base string // the name before it was qualified
+		want profileSettings
+	}{
+		{"data-prod-admin", "data-prod-admin", profileSettings{Region: "us-west-2", Env: map[string]string{}, Tags: []string{"prod"}}},
+		{"client/data-prod-admin", "data-prod-admin", profileSettings{Region: "us-west-2", Env: map[string]string{"TF_WORKSPACE": "data"}, Tags: []string{"prod", "client"}}},
+		{"555555555555/user-prod-admin", "user-prod-admin", profileSettings{Region: "us-west-2", Env: map[string]string{}, Tags: []string{"prod"}}},
+		{"111111111111/user-admin", "user-admin", profileSettings{Env: map[string]string{}, Tags: []string{"old"}}},
+		{"user-dev-admin", "user-dev-admin", profileSettings{Env: map[string]string{}}},
+	}
+	for _, tt := range tests {
+		if got := cfg.settingsFor(tt.name, badge{base: tt.base}); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
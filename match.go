@@ -0,0 +1,251 @@
+package main
+
+import (
+	"path"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// points for each query character matched in a profile name
+const (
+	ptChar     = 1 // any match
+	ptBoundary = 8 // at the start of a word (the name or after a dash)
+	ptRun      = 8 // right after the previous match, as good as a word start
+)
+
+// a winner has to beat the runner up by about a word boundary to be picked
+const clearMargin = ptBoundary
+
+// match is a profile name and how well it matched
+type match struct {
+	name  string
+	score int
+}
+
+// rankMatches scores the badges against query, best first: highest score, then
+// the shortest name, then alphabetically. badges that dont match are left out
+func rankMatches(query string, badges map[string]badge) []match {
+	terms := parseQuery(query)
+	ms := []match{}
+	for name, b := range badges {
+		if s := scoreTerms(terms, name, b); s > 0 {
+			ms = append(ms, match{name: name, score: s})
+		}
+	}
+	sort.Slice(ms, func(i, j int) bool {
+		switch {
+		case ms[i].score != ms[j].score:
+			return ms[i].score > ms[j].score
+		case len(ms[i].name) != len(ms[j].name):
+			return len(ms[i].name) < len(ms[j].name)
+		}
+		return ms[i].name < ms[j].name
+	})
+	return ms
+}
+
+// queryTerm is one part of a profile query. key says what it matches: the profile
+// name (no key), the account id, the account or the role
+type queryTerm struct {
+	key string
+	val string
+}
+
+// parseQuery splits query into terms on spaces and commas. a term like
+// id:123456789012, acct:data-dev or role:readonly matches just that part of a
+// profile
+func parseQuery(query string) []queryTerm {
+	terms := []queryTerm{}
+	for _, f := range strings.FieldsFunc(query, func(r rune) bool { return r == ',' || unicode.IsSpace(r) }) {
+		t := queryTerm{val: f}
+		if k, v, ok := strings.Cut(f, ":"); ok {
+			switch k {
+			case "id", "role":
+				t = queryTerm{key: k, val: v}
+			case "acct", "account":
+				t = queryTerm{key: "acct", val: v}
+			}
+		}
+		if t.val != "" {
+			terms = append(terms, t)
+		}
+	}
+	return terms
+}
+
+// scoreTerms adds up the scores for every term, zero if any term doesnt match
+func scoreTerms(terms []queryTerm, name string, b badge) int {
+	total := 0
+	for _, t := range terms {
+		s := 0
+		switch t.key {
+		case "id": // ids are exact, as good as a perfect match
+			if t.val == b.id {
+				s = len(t.val) * (ptChar + ptBoundary)
+			}
+		case "acct":
+			s = fuzzyScore(t.val, b.acct)
+		case "role":
+			s = fuzzyScore(t.val, b.role)
+		default:
+			s = fuzzyScore(t.val, name)
+		}
+		if s < 1 {
+			return 0
+		}
+		total += s
+	}
+	return total
+}
+
+// clearWinner is whether the best of the ranked matches is good enough to pick
+// without asking
+func clearWinner(ms []match) bool {
+	switch len(ms) {
+	case 0:
+		return false
+	case 1:
+		return true
+	}
+	return ms[0].score >= ms[1].score+clearMargin
+}
+
+// fuzzyScore is how well query matches name, zero for not at all. the query
+// characters have to turn up in order in the name (a subsequence), scoring more
+// for word starts and runs. failing that, a couple of typos are forgiven for a
+// low score
+func fuzzyScore(query, name string) int {
+	q := []rune(strings.ToLower(query))
+	c := []rune(strings.ToLower(name))
+	if len(q) < 1 {
+		return 0
+	}
+	if s := subsequence(q, c); s > 0 {
+		return s
+	}
+
+	allowed := 0
+	switch {
+	case len(q) >= 8:
+		allowed = 2
+	case len(q) >= 4:
+		allowed = 1
+	}
+	if d := typos(q, c); d <= allowed {
+		if s := len(q) - 2*d; s > 0 {
+			return s
+		}
+		return 1
+	}
+	return 0
+}
+
+// subsequence is the best score for q as a subsequence of c, zero if it isnt
+func subsequence(q, c []rune) int {
+	pts := func(j int, run bool) int {
+		p := ptChar
+		if j == 0 || c[j-1] == '-' {
+			p += ptBoundary
+		}
+		if run {
+			p += ptRun
+		}
+		return p
+	}
+
+	// best[j] is the best score so far with the last query rune matched at c[j]
+	best := make([]int, len(c))
+	for j := range c {
+		best[j] = -1
+		if c[j] == q[0] {
+			best[j] = pts(j, false)
+		}
+	}
+	for i := 1; i < len(q); i++ {
+		next := make([]int, len(c))
+		for j := range c {
+			next[j] = -1
+			if c[j] != q[i] {
+				continue
+			}
+			for k := 0; k < j; k++ {
+				if best[k] >= 0 && best[k]+pts(j, k == j-1) > next[j] {
+					next[j] = best[k] + pts(j, k == j-1)
+				}
+			}
+		}
+		best = next
+	}
+
+	top := 0
+	for _, s := range best {
+		if s > top {
+			top = s
+		}
+	}
+	return top
+}
+
+// typos is the fewest edits (insert, delete, change, or swap two neighbours)
+// that make q match somewhere in c
+func typos(q, c []rune) int {
+	d := make([][]int, len(q)+1)
+	for i := range d {
+		d[i] = make([]int, len(c)+1)
+		d[i][0] = i // starting anywhere in c is free, so d[0][j] stays 0
+	}
+	for i := 1; i <= len(q); i++ {
+		for j := 1; j <= len(c); j++ {
+			cost := 1
+			if q[i-1] == c[j-1] {
+				cost = 0
+			}
+			d[i][j] = min3(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && q[i-1] == c[j-2] && q[i-2] == c[j-1] && d[i-2][j-2]+1 < d[i][j] {
+				d[i][j] = d[i-2][j-2] + 1
+			}
+		}
+	}
+
+	fewest := len(q)
+	for _, v := range d[len(q)] {
+		if v < fewest {
+			fewest = v
+		}
+	}
+	return fewest
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// preferred is the match with the most preferred role, when the matches are
+// all roles in the same account. prefs are globs for role names, most
+// preferred first
+func preferred(prefs []string, ms []match, badges map[string]badge) (string, bool) {
+	if len(ms) < 2 {
+		return "", false
+	}
+	first := badges[ms[0].name]
+	for _, m := range ms[1:] {
+		if b := badges[m.name]; b.id != first.id || b.p != first.p {
+			return "", false
+		}
+	}
+	for _, pref := range prefs {
+		for _, m := range ms {
+			if ok, _ := path.Match(strings.ToLower(pref), strings.ToLower(badges[m.name].role)); ok {
+				return m.name, true
+			}
+		}
+	}
+	return "", false
+}
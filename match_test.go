@@ -0,0 +1,103 @@
+package main
+
+import (
+	"path"
+	"strings"
+	"testing"
+)
+
+// users are profiles in two accounts with the same roles
+var users = []string{"user-dev-admin", "user-dev-readonly", "user-prod-admin", "user-prod-readonly", "vault-prod-readonly"}
+
+// testBadges makes badges for profile names, the account is the name up to the
+// last dash and the role the rest
+func testBadges(names []string) map[string]badge {
+	p := &profile{}
+	badges := map[string]badge{}
+	for _, n := range names {
+		i := strings.LastIndex(n, "-")
+		badges[n] = badge{id: n[:i], acct: n[:i], role: n[i+1:], p: p}
+	}
+	return badges
+}
+
+func TestRankMatches(t *testing.T) {
+	tests := []struct {
+		query string
+		names []string
+		want  string // a glob every close contender has to match
+		clear bool   // whether the best is picked without asking
+	}{
+		// word starts
+		{"ud", users, "user-dev-*", false},
+		{"uda", users, "user-dev-admin", true},
+		// letters left out
+		{"usr-dev", users, "user-dev-*", false},
+		{"usr-dev-ro", users, "user-dev-readonly", true},
+		// a typo
+		{"uesr-dev", users, "user-dev-*", false},
+		// a whole word beats the same letters inside one
+		{"prod", []string{"acme-nonprod-admin", "acme-network-prod-admin"}, "acme-network-prod-admin", true},
+		{"nonprod", []string{"acme-nonprod-admin", "acme-network-prod-admin"}, "acme-nonprod-admin", true},
+	}
+	for _, tt := range tests {
+		ranked := rankMatches(tt.query, testBadges(tt.names))
+		if len(ranked) < 1 {
+			t.Errorf("%q: no matches", tt.query)
+			continue
+		}
+		for _, m := range ranked {
+			if m.score <= ranked[0].score-clearMargin {
+				break
+			}
+			if ok, _ := path.Match(tt.want, m.name); !ok {
+				t.Errorf("%q: %s is a contender, want only %s: %v", tt.query, m.name, tt.want, ranked)
+			}
+		}
+		if got := clearWinner(ranked); got != tt.clear {
+			t.Errorf("%q: clear winner %v, want %v: %v", tt.query, got, tt.clear, ranked)
+		}
+	}
+}
+
+func TestQueryTerms(t *testing.T) {
+	// accounts are named like "Acme Data Dev", rewritten to data-dev, and the
+	// roles are the raw permission set names
+	p := &profile{}
+	badges := map[string]badge{
+		"data-dev-admin":    {id: "111111111111", acct: "data-dev", role: "AWSReservedSSO_AdministratorAccess_0a1b", p: p},
+		"data-dev-readonly": {id: "111111111111", acct: "data-dev", role: "AWSReservedSSO_ReadOnlyAccess_2c3d", p: p},
+		"data-prod-admin":   {id: "222222222222", acct: "data-prod", role: "AWSReservedSSO_AdministratorAccess_0a1b", p: p},
+		"tools-readonly":    {id: "333333333333", acct: "tools", role: "AWSReservedSSO_ReadOnlyAccess_2c3d", p: p},
+	}
+	tests := []struct {
+		query string
+		want  []string // every match, best first
+	}{
+		// ids are exact
+		{"id:111111111111", []string{"data-dev-admin", "data-dev-readonly"}},
+		{"id:11111111111", []string{}},
+		{"id:data", []string{}},
+		// the account is the rewritten slug, not the name from sso
+		{"acct:data-prod", []string{"data-prod-admin"}},
+		{"account:tools", []string{"tools-readonly"}},
+		{"acct:acme", []string{}},
+		{"acct:admin", []string{}},
+		// the role is the permission set name, not the profile name
+		{"role:administrator", []string{"data-dev-admin", "data-prod-admin"}},
+		{"role:awsreserved", []string{"data-dev-admin", "tools-readonly", "data-prod-admin", "data-dev-readonly"}},
+		// every term has to match
+		{"acct:data-dev role:readonly", []string{"data-dev-readonly"}},
+		{"id:222222222222,role:readonly", []string{}},
+		{"tools nothing-like-it", []string{}},
+	}
+	for _, tt := range tests {
+		got := []string{}
+		for _, m := range rankMatches(tt.query, badges) {
+			got = append(got, m.name)
+		}
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("%q: got %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
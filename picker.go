@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// terminal escapes for the picker, it draws on an alternate screen so the
+// terminal is left as it was found
+const (
+	tAltOn   = "\033[?1049h"
+	tAltOff  = "\033[?1049l"
+	tClear   = "\033[H\033[2J"
+	tReverse = "\033[7m"
+	tDim     = "\033[2m"
+	tReset   = "\033[0m"
+)
+
+// pickable is whether there's a terminal to run the picker on. the picker
+// draws on stderr so stdout can still be captured, e.g. $(lash -u)
+func pickable() bool {
+	return runtime.GOOS != "windows" &&
+		term.IsTerminal(int(os.Stdin.Fd())) &&
+		term.IsTerminal(int(os.Stderr.Fd()))
+}
+
+// pick lets the user choose a profile from badges full-screen, filtering on
+// what they type (query to start with). before anything's typed the most used
+// profiles come first. ok is false if they gave up
+func pick(cfg config, query string, badges map[string]badge, hist history) (choice string, ok bool, err error) {
+	names := make([]string, 0, len(badges))
+	for name := range badges {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fs := hist.frecency()
+	sort.SliceStable(names, func(i, j int) bool { return fs[names[i]] > fs[names[j]] })
+
+	fd := int(os.Stdin.Fd())
+	old, err := term.MakeRaw(fd)
+	if err != nil {
+		return "", false, fmt.Errorf("cant put the terminal in raw mode: %w", err)
+	}
+	fmt.Fprint(os.Stderr, tAltOn)
+	defer func() {
+		fmt.Fprint(os.Stderr, tAltOff)
+		_ = term.Restore(fd, old)
+	}()
+
+	pk := picker{query: query, filter: func(query string) []string {
+		if query == "" {
+			return names
+		}
+		shown := []string{}
+		for _, m := range rankMatches(query, badges) {
+			shown = append(shown, m.name)
+		}
+		return shown
+	}}
+	pk.shown = pk.filter(query)
+	top := 0
+	buf := make([]byte, 64)
+	for {
+		_, height, err := term.GetSize(int(os.Stderr.Fd()))
+		if err != nil || height < 4 {
+			height = 24
+		}
+		rows := height - 2
+		switch {
+		case pk.sel < top:
+			top = pk.sel
+		case pk.sel >= top+rows:
+			top = pk.sel - rows + 1
+		}
+		drawPicker(cfg, pk.query, badges, pk.shown, pk.sel, top, rows)
+
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return "", false, fmt.Errorf("cant read the terminal: %w", err)
+		}
+		if choice, done := pk.keys(buf[:n]); done {
+			return choice, choice != "", nil
+		}
+	}
+}
+
+// picker is what's typed, the profiles it shows and the selected one
+type picker struct {
+	query  string
+	shown  []string
+	sel    int
+	filter func(query string) []string
+}
+
+// keys handles one read from the terminal. a read can hold more than one key
+// when they're batched over ssh or in tmux, or pasted. done is when a profile
+// was picked, or the user gave up and choice is empty
+func (p *picker) keys(buf []byte) (choice string, done bool) {
+	for i := 0; i < len(buf); i++ {
+		switch k := buf[i]; {
+		case k == 0x1b && i+2 < len(buf) && (buf[i+1] == '[' || buf[i+1] == 'O'):
+			switch buf[i+2] {
+			case 'A':
+				p.move(-1)
+			case 'B':
+				p.move(1)
+			}
+			i += 2
+		case k == 0x1b, k == 3, k == 4: // esc, ctrl-c, ctrl-d
+			return "", true
+		case k == '\r' || k == '\n':
+			if len(p.shown) > 0 {
+				return p.shown[p.sel], true
+			}
+		case k == 16: // ctrl-p
+			p.move(-1)
+		case k == 14: // ctrl-n
+			p.move(1)
+		case k == 127 || k == 8: // backspace
+			if len(p.query) > 0 {
+				p.query = p.query[:len(p.query)-1]
+				p.shown, p.sel = p.filter(p.query), 0
+			}
+		case k == 21: // ctrl-u
+			p.query = ""
+			p.shown, p.sel = p.filter(p.query), 0
+		case k >= 0x20 && k < 0x7f:
+			p.query += string(k)
+			p.shown, p.sel = p.filter(p.query), 0
+		}
+	}
+	return "", false
+}
+
+// move moves the selection by d, staying on the list
+func (p *picker) move(d int) {
+	p.sel += d
+	if p.sel >= len(p.shown) {
+		p.sel = len(p.shown) - 1
+	}
+	if p.sel < 0 {
+		p.sel = 0
+	}
+}
+
+// drawPicker draws the query, then a screenful of profiles from top with the
+// account id and role beside each and the selected one highlighted
+func drawPicker(cfg config, query string, badges map[string]badge, shown []string, sel, top, rows int) {
+	width := 0
+	for _, name := range shown {
+		if len(name) > width {
+			width = len(name)
+		}
+	}
+
+	var b bytes.Buffer
+	b.WriteString(tClear)
+	fmt.Fprintf(&b, "profile ~> %s\r\n", query)
+	for i := top; i < len(shown) && i < top+rows; i++ {
+		bd := badges[shown[i]]
+		line := fmt.Sprintf("  %-*s  %s  %s", width, shown[i], bd.id, bd.role)
+		if tags := cfg.settingsFor(shown[i], bd).Tags; len(tags) > 0 {
+			line += "  [" + strings.Join(tags, " ") + "]"
+		}
+		if i == sel {
+			line = tReverse + line + tReset
+		}
+		b.WriteString(line + "\r\n")
+	}
+	fmt.Fprintf(&b, "%s  %d/%d  up/down to move, enter to pick, esc to give up%s", tDim, len(shown), len(badges), tReset)
+	fmt.Fprintf(&b, "\033[1;%dH", len("profile ~> ")+len(query)+1)
+	_, _ = os.Stderr.Write(b.Bytes())
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestPickerKeys feeds the picker reads holding several keys, like a batched
+// or pasted read from the terminal
+func TestPickerKeys(t *testing.T) {
+	names := []string{"user-dev-admin", "user-dev-readonly", "user-prod-admin"}
+	tests := []struct {
+		keys string
+		want string // the profile picked, empty for giving up
+		done bool
+	}{
+		{"\r", "user-dev-admin", true},
+		{"\x1b[B\r", "user-dev-readonly", true},
+		{"\x1bOB\x1bOB\r", "user-prod-admin", true},
+		// moving off either end of the list stays on it
+		{"\x1b[A\r", "user-dev-admin", true},
+		{"\x1b[A\x1b[A\x10\r", "user-dev-admin", true},
+		{"\x1b[B\x1b[B\x1b[B\x0e\r", "user-prod-admin", true},
+		// typing filters, and the selection starts again at the top
+		{"\x1b[Bprod\r", "user-prod-admin", true},
+		{"prod\x1b[B\r", "user-prod-admin", true},
+		{"xyz\r", "", false},
+		{"xyz\x1b[B\x1b[A\r", "", false},
+		{"xyz\x7f\x7f\x7f\x1b[B\r", "user-dev-readonly", true},
+		{"xyz\x15\r", "user-dev-admin", true},
+		// giving up
+		{"\x1b", "", true},
+		{"dev\x03", "", true},
+	}
+	for _, tt := range tests {
+		p := picker{filter: func(query string) []string {
+			shown := []string{}
+			for _, n := range names {
+				if strings.Contains(n, query) {
+					shown = append(shown, n)
+				}
+			}
+			return shown
+		}}
+		p.shown = p.filter("")
+		choice, done := p.keys([]byte(tt.keys))
+		if choice != tt.want || done != tt.done {
+			t.Errorf("%q: got %q %v, want %q %v", tt.keys, choice, done, tt.want, tt.done)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// rewrite is a regex find and replace rule for account or role names. replace
+// can refer to groups in find, e.g. "$1"
+type rewrite struct {
+	Find    string `json:"find"`
+	Replace string `json:"replace"`
+
+	re *regexp.Regexp
+}
+
+// rewrites are applied in order, each to the result of the last
+type rewrites []rewrite
+
+// compile checks and compiles every rule, key names the list in errors
+func (rs rewrites) compile(key string) error {
+	for i := range rs {
+		re, err := regexp.Compile(rs[i].Find)
+		if err != nil {
+			return fmt.Errorf("config error: %s rule %d: %w", key, i+1, err)
+		}
+		rs[i].re = re
+	}
+	return nil
+}
+
+// apply runs the rules over s
+func (rs rewrites) apply(s string) string {
+	for _, r := range rs {
+		if r.re != nil {
+			s = r.re.ReplaceAllString(s, r.Replace)
+		}
+	}
+	return s
+}